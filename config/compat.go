@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// modelSpeakers lists the speakers a dialog model can synthesize. Update this
+// table when Doubao changes model/speaker support; models missing from it are
+// not checked.
+var modelSpeakers = map[string]speakerSet{
+	// O and O2.0 only ship the built-in jupiter voices.
+	"O":       {names: jupiterSpeakers},
+	"1.2.1.0": {names: jupiterSpeakers},
+	// SC and SC2.0 use character and cloned voices.
+	"SC":      {prefixes: []string{"S_", "saturn_"}},
+	"2.2.0.0": {prefixes: []string{"S_", "saturn_"}},
+}
+
+var jupiterSpeakers = []string{
+	"zh_female_vv_jupiter_bigtts",
+	"zh_female_xiaohe_jupiter_bigtts",
+	"zh_male_yunzhou_jupiter_bigtts",
+	"zh_male_xiaotian_jupiter_bigtts",
+}
+
+type speakerSet struct {
+	names    []string
+	prefixes []string
+}
+
+func (s speakerSet) allows(speaker string) bool {
+	if slices.Contains(s.names, speaker) {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(speaker, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSpeakerModel reports whether speaker can be used with model.
+func CheckSpeakerModel(speaker, model string) error {
+	set, ok := modelSpeakers[model]
+	if !ok || set.allows(speaker) {
+		return nil
+	}
+	return fmt.Errorf("speaker %s is not supported by model %s", speaker, model)
+}
+
+// ModelCapabilities are the optional features a dialog model provides, as
+// served by GET /models so clients can hide what the model lacks.
+type ModelCapabilities struct {
+	Singing   bool `json:"singing"`
+	Websearch bool `json:"websearch"`
+	ToolUse   bool `json:"tool_use"`
+}
+
+// modelCapabilities lists what each dialog model supports. Like
+// modelSpeakers it must be updated when Doubao changes a model; only models
+// listed here may be selected per session.
+var modelCapabilities = map[string]ModelCapabilities{
+	// O lost singing in a server-side update; O2.0 sings again.
+	"O":       {Websearch: true},
+	"1.2.1.0": {Singing: true, Websearch: true},
+	// The SC character models have neither.
+	"SC":      {},
+	"2.2.0.0": {},
+}
+
+// LookupModel returns the capabilities of model, false when it is not in the
+// table.
+func LookupModel(model string) (ModelCapabilities, bool) {
+	caps, ok := modelCapabilities[model]
+	return caps, ok
+}
+
+// Models returns the dialog models sessions may use, sorted: the configured
+// model plus allowed_models, or every model in the table when
+// allowed_models is empty.
+func (d DialogConfig) Models() []string {
+	models := []string{d.Extra.Model}
+	if len(d.AllowedModels) > 0 {
+		models = append(models, d.AllowedModels...)
+	} else {
+		for model := range modelCapabilities {
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models)
+	return slices.Compact(models)
+}
+
+// CheckModel reports whether a session may switch to model: besides the
+// configured model it must be one of d.Models() with known capabilities,
+// and provide websearch when the dialog enables it.
+func CheckModel(model string, d DialogConfig) error {
+	if model == d.Extra.Model {
+		return nil
+	}
+	caps, ok := LookupModel(model)
+	if !ok || !slices.Contains(d.Models(), model) {
+		return fmt.Errorf("model %s is not available, use one of %s", model, strings.Join(d.Models(), ", "))
+	}
+	if d.Extra.EnableVolcWebsearch && !caps.Websearch {
+		return fmt.Errorf("model %s has no websearch, which session.dialog.extra.enable_volc_websearch needs", model)
+	}
+	return nil
+}
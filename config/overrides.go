@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// overrideFields maps the dotted config paths that can be overridden from
+// the command line to setters. Only the fields people change while
+// experimenting are listed; everything else is edited in config.yaml.
+var overrideFields = map[string]func(c *Config, value string) error{
+	"server.host": func(c *Config, v string) error {
+		c.Server.Host = v
+		return nil
+	},
+	"server.port": func(c *Config, v string) error {
+		return setInt(&c.Server.Port, v)
+	},
+	"session.tts.speaker": func(c *Config, v string) error {
+		c.Session.TTS.Speaker = v
+		return nil
+	},
+	"session.dialog.bot_name": func(c *Config, v string) error {
+		c.Session.Dialog.BotName = v
+		return nil
+	},
+	// The model lives under dialog.extra in the file, the flag keeps the
+	// shorter name.
+	"session.dialog.model": func(c *Config, v string) error {
+		c.Session.Dialog.Extra.Model = v
+		return nil
+	},
+}
+
+func setInt(field *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*field = n
+	return nil
+}
+
+// OverridePaths lists the paths WithOverrides accepts, sorted.
+func OverridePaths() []string {
+	paths := make([]string, 0, len(overrideFields))
+	for path := range overrideFields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// WithOverrides sets config fields by dotted path (see OverridePaths) after
+// the file is decoded and before it is validated, so overridden values are
+// checked like any other.
+func WithOverrides(overrides map[string]string) LoadOption {
+	return func(o *loadOptions) {
+		o.overrides = overrides
+	}
+}
+
+func (c *Config) applyOverrides(overrides map[string]string) error {
+	for path, value := range overrides {
+		set, ok := overrideFields[path]
+		if !ok {
+			return fmt.Errorf("config override %s: unknown path", path)
+		}
+		if err := set(c, value); err != nil {
+			return fmt.Errorf("config override %s=%q: %w", path, value, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Env names the environment variable main reads the config from, as YAML,
+// when no -config is given and it is set. Container platforms often hand
+// the config over this way rather than as a file.
+const Env = "MEOW_CONFIG"
+
+// envSourcePrefix marks a source naming an environment variable that holds
+// the YAML, e.g. "env:MEOW_CONFIG".
+const envSourcePrefix = "env:"
+
+// fetchTimeout bounds fetching a config from a URL.
+const fetchTimeout = 10 * time.Second
+
+// openSource opens the config named by source, selected by its form: an
+// http:// or https:// URL is fetched, "env:NAME" reads the YAML from the
+// environment variable NAME, and anything else is a file path.
+func openSource(source string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return fetchSource(source)
+	case strings.HasPrefix(source, envSourcePrefix):
+		name := strings.TrimPrefix(source, envSourcePrefix)
+		data, ok := os.LookupEnv(name)
+		if !ok || strings.TrimSpace(data) == "" {
+			return nil, fmt.Errorf("open config: environment variable %s is empty", name)
+		}
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("open config: %w", err)
+	}
+	return f, nil
+}
+
+func fetchSource(source string) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch config failed status=%d body=%.200s", resp.StatusCode, data)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	tmplparse "text/template/parse"
+)
+
+// session.dialog.system_role and personal_greeting may be Go templates,
+// e.g. "用户叫{{.UserName}}", filled in per session from the start message's
+// metadata. Every variable a template references is required; text without
+// "{{" is used as is.
+
+// parseTemplate parses the template at the yaml path.
+func parseTemplate(path, text string) (*template.Template, error) {
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid template: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// missingVars lists the variables tmpl references that vars lacks.
+func missingVars(tmpl *template.Template, vars map[string]string) []string {
+	var missing []string
+	for _, name := range templateFields(tmpl.Tree.Root) {
+		if _, ok := vars[name]; !ok && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func execute(path string, tmpl *template.Template, vars map[string]string) (string, error) {
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("render %s: %w", path, err)
+	}
+	return b.String(), nil
+}
+
+// RenderSystemRole fills the system_role template from vars. It fails
+// naming every variable the template needs that vars lacks.
+func RenderSystemRole(role string, vars map[string]string) (string, error) {
+	const path = "session.dialog.system_role"
+	if !strings.Contains(role, "{{") {
+		return role, nil
+	}
+	tmpl, err := parseTemplate(path, role)
+	if err != nil {
+		return "", err
+	}
+	if missing := missingVars(tmpl, vars); len(missing) > 0 {
+		return "", fmt.Errorf("%s needs metadata %s", path, strings.Join(missing, ", "))
+	}
+	return execute(path, tmpl, vars)
+}
+
+// RenderPersonalGreeting fills the personal_greeting template from vars.
+// It reports false when there is none or vars lacks one of its variables,
+// and the usual greeting is used. The result keeps the template's %s for
+// bot_name, with any % in the values escaped.
+func RenderPersonalGreeting(d DialogConfig, vars map[string]string) (string, bool) {
+	const path = "session.dialog.personal_greeting"
+	if d.PersonalGreeting == "" {
+		return "", false
+	}
+	tmpl, err := parseTemplate(path, d.PersonalGreeting)
+	if err != nil || len(missingVars(tmpl, vars)) > 0 {
+		return "", false
+	}
+	if strings.Contains(d.PersonalGreeting, "%s") {
+		escaped := make(map[string]string, len(vars))
+		for k, v := range vars {
+			escaped[k] = strings.ReplaceAll(v, "%", "%%")
+		}
+		vars = escaped
+	}
+	text, err := execute(path, tmpl, vars)
+	if err != nil {
+		return "", false
+	}
+	return text, true
+}
+
+// templateFields lists the top-level fields (.Name) a template references.
+// The bodies of range and with are skipped since dot means something else
+// there.
+func templateFields(node tmplparse.Node) []string {
+	var names []string
+	var walk func(tmplparse.Node)
+	walk = func(node tmplparse.Node) {
+		switch n := node.(type) {
+		case *tmplparse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *tmplparse.ActionNode:
+			walk(n.Pipe)
+		case *tmplparse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *tmplparse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *tmplparse.FieldNode:
+			names = append(names, n.Ident[0])
+		case *tmplparse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *tmplparse.RangeNode:
+			walk(n.Pipe)
+		case *tmplparse.WithNode:
+			walk(n.Pipe)
+		}
+	}
+	walk(node)
+	return names
+}
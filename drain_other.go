@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "meow-ai/server"
+
+// notifyDrain is a no-op without SIGUSR1; use POST /admin/drain instead.
+func notifyDrain(*server.Handler) {}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"meow-ai/server"
+)
+
+// notifyDrain drains the handler on SIGUSR1, so a deploy can take the
+// instance out of rotation before it sends SIGTERM.
+func notifyDrain(h *server.Handler) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			h.Drain()
+		}
+	}()
+}
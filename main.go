@@ -3,23 +3,50 @@ package main
 import (
 	"context"
 	"flag"
+	"net"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"google.golang.org/grpc"
 
 	"meow-ai/config"
+	"meow-ai/rpc"
 	"meow-ai/server"
 )
 
 func main() {
 	_ = flag.Set("logtostderr", "true")
+	overrides := make(map[string]*string)
+	for _, path := range config.OverridePaths() {
+		overrides[path] = flag.String(path, "", "override "+path+" from config.yaml")
+	}
+	configSource := flag.String("config", "config.yaml", "config file path, http(s) URL, or env:NAME for YAML in an environment variable; defaults to env:"+config.Env+" when that is set")
 	flag.Parse()
 
-	cfg := config.MustLoad("config.yaml")
+	// Only flags given on the command line override the file.
+	set := make(map[string]string)
+	sourceGiven := false
+	flag.Visit(func(f *flag.Flag) {
+		if v, ok := overrides[f.Name]; ok {
+			set[f.Name] = *v
+		}
+		sourceGiven = sourceGiven || f.Name == "config"
+	})
+	source := *configSource
+	if !sourceGiven && os.Getenv(config.Env) != "" {
+		source = "env:" + config.Env
+	}
+	loadOpts := []config.LoadOption{config.WithOverrides(set)}
+	cfg := config.MustLoad(source, loadOpts...)
+	if flag.Arg(0) == "probe" {
+		os.Exit(runProbe(cfg, flag.Args()[1:]))
+	}
 	handler := server.NewHandler(cfg)
+	handler.SetConfigPath(source, loadOpts...)
 
 	mux := http.NewServeMux()
 	handler.Register(mux)
@@ -34,11 +61,43 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	notifyDrain(handler)
+
+	var grpcSrv *grpc.Server
+	if addr := cfg.GRPCAddr(); addr != "" {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			glog.Fatalf("grpc listen: %v", err)
+		}
+		grpcSrv = grpc.NewServer()
+		rpc.NewRealtimeServer(handler).Register(grpcSrv)
+		go func() {
+			glog.Infof("grpc listening on %s", addr)
+			if err := grpcSrv.Serve(lis); err != nil {
+				glog.Errorf("grpc server error: %v", err)
+			}
+		}()
+	}
 
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
+		if err := handler.Shutdown(shutdownCtx); err != nil {
+			glog.Warningf("session drain error: %v", err)
+		}
+		if grpcSrv != nil {
+			stopped := make(chan struct{})
+			go func() {
+				grpcSrv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-shutdownCtx.Done():
+				grpcSrv.Stop()
+			}
+		}
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			glog.Warningf("server shutdown error: %v", err)
 		}
@@ -0,0 +1,54 @@
+// Package metrics holds process-wide counters published through expvar and
+// served as JSON on /metrics.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+var (
+	// EventsDropped counts events discarded because a session's event
+	// channel was full.
+	EventsDropped = expvar.NewInt("events_dropped")
+	// SessionsDegraded counts sessions that exceeded the drop threshold.
+	SessionsDegraded = expvar.NewInt("sessions_degraded")
+	// ResamplerInputSamples and ResamplerOutputSamples count mono samples
+	// entering and leaving the input resampler across all sessions.
+	ResamplerInputSamples  = expvar.NewInt("resampler_input_samples")
+	ResamplerOutputSamples = expvar.NewInt("resampler_output_samples")
+	// SessionsReaped counts sessions force-closed by the idle reaper.
+	SessionsReaped = expvar.NewInt("sessions_reaped")
+	// SessionsStalled counts sessions ended because Doubao went quiet past
+	// session.read_stall_timeout_ms.
+	SessionsStalled = expvar.NewInt("sessions_stalled")
+	// RateLimited counts rate-limit responses from Volcengine.
+	RateLimited = expvar.NewInt("rate_limited")
+	// AudioMemoryBytes is the TTS audio currently buffered across sessions.
+	AudioMemoryBytes = expvar.NewInt("audio_memory_bytes")
+	// AudioMemoryDrops counts TTS frames dropped at the memory cap.
+	AudioMemoryDrops = expvar.NewInt("audio_memory_drops")
+	// TTSFallbacks counts turns spoken by the fallback TTS because Doubao
+	// sent no audio.
+	TTSFallbacks = expvar.NewInt("tts_fallbacks")
+	// ClientStalls counts audio writes that blocked past
+	// session.tts.stall_threshold_ms because a client stopped draining.
+	ClientStalls = expvar.NewInt("client_stalls")
+	// DoubaoDialsInProgress is the Doubao dials running now, and
+	// DoubaoDialsQueued those waiting for api.reconnect.max_concurrent.
+	DoubaoDialsInProgress = expvar.NewInt("doubao_dials_in_progress")
+	DoubaoDialsQueued     = expvar.NewInt("doubao_dials_queued")
+	// AudioSeqGaps counts audio messages missing from client seq numbers,
+	// and AudioCRCMismatches those whose crc did not match, both only with
+	// session.audio_integrity on.
+	AudioSeqGaps       = expvar.NewInt("audio_seq_gaps")
+	AudioCRCMismatches = expvar.NewInt("audio_crc_mismatches")
+	// WebhookDrops counts transcripts the ASR webhook never received, on a
+	// full queue or after the last retry.
+	WebhookDrops = expvar.NewInt("webhook_drops")
+)
+
+// Handler serves all published variables.
+func Handler() http.Handler {
+	return expvar.Handler()
+}
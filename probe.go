@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"meow-ai/config"
+	"meow-ai/voice"
+)
+
+// runProbe implements `meow-ai probe`: it connects to a running server's
+// /ws/realtime, plays a short WAV into it and reports the events and whether
+// audio came back. It exits non-zero when the server never gets ready,
+// reports an error or sends no audio, so it doubles as a deployment smoke
+// test. It is also the smallest complete client of the frontend protocol.
+func runProbe(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	addr := fs.String("addr", probeAddr(cfg), "server host:port")
+	wavPath := fs.String("wav", "", "16-bit, 24-bit or float WAV to send, default a generated 1s tone")
+	wait := fs.Duration("wait", 15*time.Second, "how long to wait for the reply after sending")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := probe(*addr, *wavPath, *wait); err != nil {
+		fmt.Fprintf(os.Stderr, "probe failed: %v\n", err)
+		return 1
+	}
+	fmt.Println("probe ok")
+	return 0
+}
+
+// probeAddr is the configured listen address, dialing loopback when the
+// server listens on all interfaces.
+func probeAddr(cfg *config.Config) string {
+	host := cfg.Server.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cfg.Server.Port))
+}
+
+// probeWAV returns the WAV to send: the file at path, or a generated tone.
+func probeWAV(path string) ([]byte, voice.WAVHeader, error) {
+	var data []byte
+	if path == "" {
+		const rate = 16000
+		tone := voice.ToneFrames(rate, "pcm_s16le", 440, rate, rate)[0]
+		data = voice.EncodeWAV(tone, rate, 1)
+	} else {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, voice.WAVHeader{}, err
+		}
+	}
+	h, err := voice.ParseWAVHeader(data)
+	if err != nil {
+		return nil, voice.WAVHeader{}, fmt.Errorf("parse probe wav: %w", err)
+	}
+	return data, h, nil
+}
+
+func probe(addr, wavPath string, wait time.Duration) error {
+	wav, header, err := probeWAV(wavPath)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Scheme: "ws", Host: addr, Path: "/ws/realtime"}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", u.String(), err)
+	}
+	defer conn.Close()
+
+	encoding := voice.EncodingS16
+	switch header.BitsPerSample {
+	case 24:
+		encoding = voice.EncodingS24
+	case 32:
+		encoding = voice.EncodingF32
+	}
+	if err := conn.WriteJSON(map[string]any{
+		"type":       "start",
+		"sampleRate": header.SampleRate,
+		"encoding":   encoding,
+	}); err != nil {
+		return fmt.Errorf("send start: %w", err)
+	}
+
+	type result struct {
+		audioBytes int
+		err        error
+	}
+	ready := make(chan struct{})
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		readyClosed := false
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				if !readyClosed {
+					err = fmt.Errorf("no ready from server: %w", err)
+				} else if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					err = nil
+				}
+				res.err = err
+				done <- res
+				return
+			}
+			if mt == websocket.BinaryMessage {
+				res.audioBytes += len(data)
+				continue
+			}
+			var evt struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			}
+			_ = json.Unmarshal(data, &evt)
+			fmt.Printf("event %s\n", data)
+			switch evt.Type {
+			case "ready":
+				if !readyClosed {
+					readyClosed = true
+					close(ready)
+				}
+			case "error", "try_later":
+				res.err = fmt.Errorf("server error: %s", evt.Message)
+				done <- res
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ready:
+	case res := <-done:
+		return res.err
+	case <-time.After(20 * time.Second):
+		return errors.New("timed out waiting for ready")
+	}
+
+	// The header must arrive whole in the first frame; after it, send
+	// 100 ms frames at playback speed like a live client.
+	frame := max(header.SampleRate*header.Channels*header.BitsPerSample/8/10, 1)
+	first := min(header.DataOffset+frame, len(wav))
+	chunks := [][]byte{wav[:first]}
+	for rest := wav[first:]; len(rest) > 0; {
+		n := min(frame, len(rest))
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	// Trailing silence lets the server's VAD end the utterance.
+	silence := make([]byte, frame)
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, silence)
+	}
+	for _, chunk := range chunks {
+		if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			return fmt.Errorf("send audio: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(wait):
+		_ = conn.WriteJSON(map[string]any{"type": "stop"})
+		select {
+		case res = <-done:
+		case <-time.After(5 * time.Second):
+			return errors.New("server did not close after stop")
+		}
+	}
+	if res.err != nil {
+		return res.err
+	}
+	fmt.Printf("received %d bytes of audio\n", res.audioBytes)
+	if res.audioBytes == 0 {
+		return errors.New("no audio came back")
+	}
+	return nil
+}
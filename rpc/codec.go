@@ -0,0 +1,24 @@
+package rpc
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// codecName is the gRPC content subtype the service speaks
+// ("application/grpc+json"). Messages are plain Go structs, so no protoc
+// toolchain is needed on either side.
+const codecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) Name() string { return codecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
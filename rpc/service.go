@@ -0,0 +1,73 @@
+// Package rpc exposes the realtime voice pipeline as a bidirectional gRPC
+// stream for non-browser services.
+package rpc
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc"
+)
+
+// StartRequest negotiates the input format, like the websocket start message.
+type StartRequest struct {
+	SampleRate int    `json:"sample_rate"`
+	Encoding   string `json:"encoding"`
+}
+
+// ConverseRequest is one client message. The first message must carry Start;
+// later messages carry Audio, Text or Stop. Closing the send side is a stop.
+type ConverseRequest struct {
+	Start *StartRequest `json:"start,omitempty"`
+	Audio []byte        `json:"audio,omitempty"`
+	Text  string        `json:"text,omitempty"`
+	Stop  bool          `json:"stop,omitempty"`
+}
+
+// Event mirrors voice.EventMsg with the payload kept as nested JSON.
+type Event struct {
+	Type    string          `json:"type"`
+	EventID int32           `json:"event_id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ConverseResponse carries either a TTS audio frame or an event.
+type ConverseResponse struct {
+	Audio []byte `json:"audio,omitempty"`
+	Event *Event `json:"event,omitempty"`
+}
+
+// Conversations runs Converse calls. The server package implements it, so
+// gRPC sessions share the websocket endpoints' start path and registry.
+type Conversations interface {
+	GRPCConverse(stream grpc.ServerStream) error
+}
+
+// RealtimeServer serves the meowai.Realtime service.
+type RealtimeServer struct {
+	conv Conversations
+}
+
+func NewRealtimeServer(conv Conversations) *RealtimeServer {
+	return &RealtimeServer{conv: conv}
+}
+
+// Register adds the service to s.
+func (r *RealtimeServer) Register(s *grpc.Server) {
+	s.RegisterService(&serviceDesc, r)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "meowai.Realtime",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Converse",
+		Handler:       converseHandler,
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "meowai/realtime",
+}
+
+func converseHandler(srv any, stream grpc.ServerStream) error {
+	return srv.(*RealtimeServer).conv.GRPCConverse(stream)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"meow-ai/config"
+	"meow-ai/voice"
+)
+
+// requireAdmin gates an admin endpoint behind server.admin_token, passed as
+// "Authorization: Bearer <token>".
+func (h *Handler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Server.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleCloseSession force-closes a live session, telling its client it was
+// terminated.
+func (h *Handler) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	active, ok := h.sessions.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	glog.Infof("admin terminated session %s", id)
+	active.end(endTerminated)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"closed": id})
+}
+
+// handleSessionEvents returns the recent events of a live session, oldest
+// first, without attaching to its stream. The optional n query parameter
+// keeps only the last n.
+func (h *Handler) handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	active, ok := h.sessions.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	events := active.session.RecentEvents(n)
+	if events == nil {
+		events = []voice.LoggedEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"session": id, "events": events})
+}
+
+// handleDrain flips the instance to draining, like SIGUSR1.
+func (h *Handler) handleDrain(w http.ResponseWriter, _ *http.Request) {
+	h.Drain()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"draining": true})
+}
+
+// handleReload re-reads the config source and, if it validates, swaps it in
+// for new sessions. Live sessions keep the config they started with, and
+// server-level settings (listeners, routes, limits, admin token) still need a
+// restart. An invalid config is reported and nothing is swapped.
+func (h *Handler) handleReload(w http.ResponseWriter, _ *http.Request) {
+	cfg, err := config.Load(h.configPath, h.loadOpts...)
+	if err != nil {
+		glog.Warningf("config reload rejected: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(map[string]any{"reloaded": false, "error": err.Error()})
+		return
+	}
+	old := h.live.Swap(h.newLiveConfig(cfg))
+	if old.pool != nil {
+		go old.pool.Close()
+	}
+	glog.Infof("config reloaded from %s", h.configPath)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"reloaded": true})
+}
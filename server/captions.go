@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"meow-ai/voice"
+)
+
+// handleCaptions serves a session's captions as WebVTT or SRT, picked by
+// the file extension. Live sessions answer from memory; ended ones from
+// their recording when the recorder is enabled.
+func (h *Handler) handleCaptions(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var captions []voice.Caption
+	if active, ok := h.sessions.get(id); ok {
+		captions = active.session.Captions()
+	} else if dir, ok := h.recordingDir(id); ok {
+		var err error
+		if captions, err = readCaptions(filepath.Join(dir, voice.RecordEventsFile)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.PathValue("format") {
+	case "captions.vtt":
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		_, _ = w.Write([]byte(voice.FormatVTT(captions)))
+	case "captions.srt":
+		w.Header().Set("Content-Type", "application/x-subrip; charset=utf-8")
+		_, _ = w.Write([]byte(voice.FormatSRT(captions)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func readCaptions(path string) ([]voice.Caption, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var captions []voice.Caption
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var evt voice.RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil || evt.Type != "caption" {
+			continue
+		}
+		if c, err := voice.CaptionFromPayload(evt.Payload); err == nil {
+			captions = append(captions, c)
+		}
+	}
+	return captions, scanner.Err()
+}
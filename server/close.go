@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"meow-ai/voice"
+	"meow-ai/volc"
+)
+
+// closeStatus picks the close frame sent to the frontend when a session ends.
+func closeStatus(err error, active *activeSession) (int, string) {
+	var netErr net.Error
+	switch {
+	case active.reason() == endShutdown:
+		return websocket.CloseServiceRestart, "server shutdown"
+	case active.reason() == endTerminated:
+		return websocket.ClosePolicyViolation, "terminated"
+	case active.reason() == endReaped:
+		return websocket.CloseGoingAway, "idle session reaped"
+	case err == nil && active.session.Err() == nil:
+		return websocket.CloseNormalClosure, "session ended"
+	case errors.As(active.session.Err(), new(*volc.RateLimitError)):
+		return websocket.CloseTryAgainLater, "rate limited"
+	case errors.Is(err, voice.ErrTextMode):
+		return websocket.ClosePolicyViolation, "audio not accepted in text mode"
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too big"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return websocket.CloseGoingAway, "idle timeout"
+	default:
+		return websocket.CloseInternalServerErr, "upstream error"
+	}
+}
+
+// closeConn sends a close frame. WriteControl may run concurrently with the
+// data writers, so it does not need the wsWriter lock.
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
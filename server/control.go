@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/voice"
+	"meow-ai/voices"
+)
+
+// Control messages are JSON text frames discriminated by "type". Each type
+// decodes into its own struct and is routed through controlHandlers; adding
+// a message means adding a struct and a handler entry.
+
+type controlEnvelope struct {
+	Type string `json:"type"`
+}
+
+type pingMessage struct {
+	// Timestamp is echoed back verbatim in the pong reply.
+	Timestamp json.RawMessage `json:"timestamp,omitempty"`
+}
+
+type contentMessage struct {
+	Content string `json:"content"`
+}
+
+// audioMessage carries client audio as base64 for clients that cannot send
+// binary frames. Seq is optional and only used to log gaps. CRC is the
+// CRC-32 (IEEE) of the decoded audio, checked with Seq when
+// session.audio_integrity is on.
+type audioMessage struct {
+	Data string  `json:"data"`
+	Seq  *int64  `json:"seq"`
+	CRC  *uint32 `json:"crc"`
+}
+
+type styleMessage struct {
+	Style string `json:"style"`
+}
+
+// speakerMessage names a speaker ID or a cloned voice's name.
+type speakerMessage struct {
+	Speaker string `json:"speaker"`
+}
+
+type muteMessage struct {
+	Muted bool `json:"muted"`
+}
+
+// frontend is the per-session state control handlers act on. It is only
+// touched by the goroutine reading the client connection.
+type frontend struct {
+	writer  clientWriter
+	session *voice.Session
+	// voices resolves cloned voice names for set_speaker; nil without
+	// voice cloning.
+	voices   *voices.Store
+	ackCh    chan<- struct{}
+	replayCh chan<- struct{}
+	acked    bool
+	// emptyFinishes treats an empty binary frame as end of utterance.
+	emptyFinishes bool
+	// muted drops client audio until the client unmutes.
+	muted bool
+	// lastSeq is the seq of the last audio text message, if seqSeen.
+	lastSeq int64
+	seqSeen bool
+	// integrity hands seq and crc to Session.CheckAudioFrame instead.
+	integrity bool
+}
+
+// controlHandler handles one decoded message type. Returning errStop ends
+// the frontend pipe cleanly; any other error ends the session.
+type controlHandler func(f *frontend, data []byte) error
+
+var errStop = errors.New("client stopped")
+
+// controlError is a malformed or unknown control message. It is reported to
+// the client and the session continues.
+type controlError struct {
+	code string
+	msg  string
+}
+
+func (e *controlError) Error() string {
+	return e.msg
+}
+
+var controlHandlers = map[string]controlHandler{
+	"start":       handleRepeatedStart,
+	"stop":        handleStop,
+	"finish":      handleFinish,
+	"ping":        handlePing,
+	"ack":         handleAck,
+	"text":        handleText,
+	"context":     handleContext,
+	"replay_last": handleReplayLast,
+	"mute":        handleMute,
+	"interrupt":   handleInterrupt,
+	"audio":       handleAudio,
+	"set_style":   handleSetStyle,
+	"set_speaker": handleSetSpeaker,
+}
+
+// dispatch decodes a control frame and routes it to its handler.
+func (f *frontend) dispatch(data []byte) error {
+	var env controlEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return &controlError{code: "malformed_message", msg: fmt.Sprintf("控制消息不是合法的 JSON: %v", err)}
+	}
+	handle, ok := controlHandlers[env.Type]
+	if !ok {
+		return &controlError{code: "unknown_message_type", msg: fmt.Sprintf("未知的控制消息类型 %q", env.Type)}
+	}
+	return handle(f, data)
+}
+
+// decodeControl decodes the body of a control message of type typ.
+func decodeControl[T any](typ string, data []byte) (T, error) {
+	var msg T
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, &controlError{code: "malformed_message", msg: fmt.Sprintf("%s 消息格式不正确: %v", typ, err)}
+	}
+	return msg, nil
+}
+
+func handleRepeatedStart(*frontend, []byte) error {
+	return &controlError{code: "already_started", msg: "会话已经开始，忽略重复的 start 消息"}
+}
+
+func handleStop(f *frontend, _ []byte) error {
+	if err := f.session.Flush(); err != nil {
+		glog.Warningf("flush audio on stop: %v", err)
+	}
+	return errStop
+}
+
+// handleFinish ends the user's turn like releasing push-to-talk: buffered
+// audio is flushed and Doubao answers, but unlike stop the session stays
+// open for the next turn.
+func handleFinish(f *frontend, _ []byte) error {
+	if err := f.session.FinishInput(); err != nil {
+		if errors.Is(err, voice.ErrTextMode) {
+			return &controlError{code: "text_mode", msg: "文本输入的会话没有语音可结束，忽略 finish 消息"}
+		}
+		return err
+	}
+	return nil
+}
+
+func handlePing(f *frontend, data []byte) error {
+	msg, err := decodeControl[pingMessage]("ping", data)
+	if err != nil {
+		return err
+	}
+	pong := map[string]any{
+		"type":        "pong",
+		"timestamp":   msg.Timestamp,
+		"server_time": time.Now().UnixMilli(),
+	}
+	if err := f.session.Ping(); err != nil {
+		pong["error"] = err.Error()
+	}
+	return f.writer.writeJSON(pong)
+}
+
+func handleAck(f *frontend, _ []byte) error {
+	if !f.acked {
+		f.acked = true
+		close(f.ackCh)
+	}
+	return nil
+}
+
+func handleText(f *frontend, data []byte) error {
+	msg, err := decodeControl[contentMessage]("text", data)
+	if err != nil {
+		return err
+	}
+	if msg.Content == "" {
+		return &controlError{code: "malformed_message", msg: "text 消息的 content 不能为空"}
+	}
+	return f.session.SendText(msg.Content)
+}
+
+func handleContext(f *frontend, data []byte) error {
+	msg, err := decodeControl[contentMessage]("context", data)
+	if err != nil {
+		return err
+	}
+	if msg.Content == "" {
+		return &controlError{code: "malformed_message", msg: "context 消息的 content 不能为空"}
+	}
+	return f.session.InjectContext(msg.Content)
+}
+
+func handleReplayLast(f *frontend, _ []byte) error {
+	select {
+	case f.replayCh <- struct{}{}:
+	default: // a replay is already pending
+	}
+	return nil
+}
+
+func handleMute(f *frontend, data []byte) error {
+	msg, err := decodeControl[muteMessage]("mute", data)
+	if err != nil {
+		return err
+	}
+	f.muted = msg.Muted
+	return nil
+}
+
+func handleInterrupt(f *frontend, _ []byte) error {
+	f.session.Interrupt()
+	return nil
+}
+
+// handleAudio decodes a base64 audio message and pushes it exactly like a
+// binary frame. The websocket read limit already bounds the encoded frame,
+// so the decoded audio is always smaller than a binary frame may be.
+func handleAudio(f *frontend, data []byte) error {
+	msg, err := decodeControl[audioMessage]("audio", data)
+	if err != nil {
+		return err
+	}
+	pcm, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return &controlError{code: "malformed_message", msg: fmt.Sprintf("audio 消息的 data 不是合法的 base64: %v", err)}
+	}
+	if f.integrity {
+		f.session.CheckAudioFrame(msg.Seq, msg.CRC, pcm)
+	} else if msg.Seq != nil {
+		if f.seqSeen && *msg.Seq != f.lastSeq+1 {
+			glog.Warningf("session %s: audio seq jumped from %d to %d", f.session.ID(), f.lastSeq, *msg.Seq)
+		}
+		f.lastSeq, f.seqSeen = *msg.Seq, true
+	}
+	return f.pushAudio(pcm)
+}
+
+func handleSetStyle(f *frontend, data []byte) error {
+	msg, err := decodeControl[styleMessage]("set_style", data)
+	if err != nil {
+		return err
+	}
+	if err := f.session.SetStyle(msg.Style); err != nil {
+		if errors.Is(err, voice.ErrUnsupportedStyle) {
+			return &controlError{code: "unsupported_style", msg: err.Error()}
+		}
+		return err
+	}
+	return nil
+}
+
+func handleSetSpeaker(f *frontend, data []byte) error {
+	msg, err := decodeControl[speakerMessage]("set_speaker", data)
+	if err != nil {
+		return err
+	}
+	speaker := msg.Speaker
+	if f.voices != nil {
+		if id, ok := f.voices.Resolve(speaker); ok {
+			speaker = id
+		}
+	}
+	if err := f.session.SetSpeaker(speaker); err != nil {
+		if errors.Is(err, voice.ErrSpeakerNotAllowed) {
+			return &controlError{code: "unsupported_speaker", msg: err.Error()}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/voice"
+)
+
+// POST /converse runs one turn over plain HTTP, for backend services that
+// cannot open a websocket:
+//
+//   - The request body is the user's audio, usually sent chunked as it is
+//     captured. X-Sample-Rate and X-Encoding describe it with the same
+//     defaults as the start message; X-Dialog-Id resumes a dialog.
+//   - The response body streams the bot's audio in session.tts.audio_config
+//     format as it is produced, and X-Session-Id names the session.
+//   - When the request body ends the user's turn is finished. The response
+//     ends once the reply has played out, after the usual clean stop.
+//   - Events do not fit in an audio stream, so the typed ones (user_text,
+//     bot_text, error, ...) are sent as the X-Meow-Events trailer: a JSON
+//     array, base64 encoded since it may hold non-ASCII text. Raw Doubao
+//     events are left out.
+//
+// The whole exchange is bounded by server.converse_timeout_ms; on timeout
+// the events end with an error of code "timeout".
+
+const converseEventsTrailer = "X-Meow-Events"
+
+var errConverseDone = errors.New("converse response already finished")
+
+// converseChunk is the size of the body reads pushed to the session, a
+// multiple of every input sample size (2, 3 and 4 bytes) and channel count
+// up to two.
+const converseChunk = 12288
+
+func (h *Handler) handleConverse(w http.ResponseWriter, r *http.Request) {
+	if h.sessions.isDraining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if voice.AudioMemoryNearLimit() {
+		http.Error(w, "server is at its audio memory limit", http.StatusServiceUnavailable)
+		return
+	}
+	live := h.live.Load()
+	if live.cfg.Session.Dialog.Extra.InputMod == voice.InputModText {
+		http.Error(w, "session input_mod is text, /converse needs audio input", http.StatusBadRequest)
+		return
+	}
+	start, err := converseStart(r.Header)
+	if err == nil {
+		err = checkStart(&start, live.cfg)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.Duration(h.cfg.Server.ConverseTimeoutMS) * time.Millisecond
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	// The server's read and write timeouts are meant for short requests;
+	// this one lasts as long as the conversation. Reading the body while the
+	// reply streams needs full duplex on HTTP/1.1.
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(timeout + time.Second)
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+	if err := rc.EnableFullDuplex(); err != nil {
+		glog.V(1).Infof("converse: enable full duplex: %v", err)
+	}
+
+	session, sessCfg, err := h.startSession(ctx, live, start, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writer := &converseWriter{w: w, rc: rc}
+	active := &activeSession{writer: writer, session: session, cancel: cancel}
+	if !h.sessions.add(active) {
+		session.Close()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		session.Close()
+		h.sessions.remove(active)
+	}()
+
+	w.Header().Set("Trailer", converseEventsTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Session-Id", session.ID())
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	errCh := make(chan error, 2)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		errCh <- readConverse(r.Body, session)
+	}()
+	// Runs before the deferred session.Close: the body must not be read once
+	// the handler returns. An expired read deadline unblocks a pending read,
+	// which Body.Close would wait on instead.
+	defer func() {
+		if err := rc.SetReadDeadline(time.Now()); err != nil {
+			_ = r.Body.Close()
+		}
+		<-readDone
+	}()
+	go func() {
+		errCh <- h.pipeBackend(ctx, sessCfg.Session.TTS, writer, session, nil)
+	}()
+
+	err = <-errCh
+	if errors.Is(err, errStop) {
+		err = awaitReply(ctx, session, errCh)
+		if err == nil {
+			err = drainStop(ctx, session, errCh, sessCfg.Session.StopTimeoutMS)
+		}
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		writer.add(errorMessage(&controlError{code: "timeout", msg: fmt.Sprintf("对话超过 %dms 未结束", h.cfg.Server.ConverseTimeoutMS)}))
+	case err != nil && !errors.Is(err, context.Canceled):
+		glog.Warningf("converse session ended with error: %v", err)
+		writer.add(errorMessage(err))
+	}
+	cancel()
+	writer.finish()
+}
+
+// converseStart builds the start message /converse clients send as headers.
+func converseStart(header http.Header) (clientStartMessage, error) {
+	start := clientStartMessage{
+		Type:     "start",
+		Encoding: header.Get("X-Encoding"),
+		DialogID: header.Get("X-Dialog-Id"),
+	}
+	if v := header.Get("X-Sample-Rate"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil {
+			return clientStartMessage{}, fmt.Errorf("X-Sample-Rate 不是整数: %q", v)
+		}
+		start.SampleRate = rate
+	}
+	return start, nil
+}
+
+// readConverse pushes the request body to the session and finishes the
+// user's turn when it ends, returning errStop.
+func readConverse(body io.Reader, session *voice.Session) error {
+	for {
+		// A fresh buffer per chunk: the processing pipeline may still hold
+		// the previous one.
+		buf := make([]byte, converseChunk)
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if err := session.PushAudio(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if err := session.FinishInput(); err != nil {
+				return err
+			}
+			return errStop
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// awaitReply waits for the reply owed to the user's finished turn to play
+// out, the same wait Stop does, returning early when the backend ends or the
+// request is done. Unlike drainStop it is not bounded by
+// session.stop_timeout_ms, since the whole reply is the response.
+func awaitReply(ctx context.Context, session *voice.Session, errCh <-chan error) error {
+	select {
+	case <-session.ReplyIdle():
+		return nil
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// converseWriter streams TTS audio into the response body and keeps the
+// typed events for the trailer.
+type converseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	mu     sync.Mutex
+	events []any
+	// done is set by finish; the response is complete, so later writes
+	// from a backend still winding down are dropped.
+	done bool
+}
+
+func (c *converseWriter) writeJSON(v any) error {
+	if msg, ok := v.(map[string]any); ok && msg["type"] == "event" {
+		return nil
+	}
+	c.add(v)
+	return nil
+}
+
+func (c *converseWriter) add(v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		c.events = append(c.events, v)
+	}
+}
+
+func (c *converseWriter) Write(pcm []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return errConverseDone
+	}
+	if _, err := c.w.Write(pcm); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// Close is a no-op: the response ends when handleConverse returns.
+func (c *converseWriter) Close() error {
+	return nil
+}
+
+// finish sets the events trailer and ends the writer.
+func (c *converseWriter) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	events := c.events
+	if events == nil {
+		events = []any{}
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		glog.Warningf("marshal converse events: %v", err)
+		return
+	}
+	c.w.Header().Set(converseEventsTrailer, base64.StdEncoding.EncodeToString(data))
+}
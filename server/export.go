@@ -0,0 +1,135 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+
+	"meow-ai/voice"
+)
+
+type transcriptTurn struct {
+	Role string    `json:"role"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// handleExport bundles a recorded session into a zip with both audio tracks,
+// the raw event log and a transcript derived from it. A live session is
+// refused: its WAV headers are only finalized when the recorder closes.
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, live := h.sessions.get(id); live {
+		http.Error(w, "session is still live", http.StatusConflict)
+		return
+	}
+	dir, ok := h.recordingDir(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	turns, err := readTranscript(filepath.Join(dir, voice.RecordEventsFile))
+	if err != nil {
+		glog.Warningf("build transcript for %s: %v", dir, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(dir)+`.zip"`)
+	zw := zip.NewWriter(w)
+	for _, name := range []string{voice.RecordUserFile, voice.RecordBotFile, voice.RecordEventsFile} {
+		if err := addZipFile(zw, dir, name); err != nil {
+			glog.Warningf("export %s/%s: %v", dir, name, err)
+			return
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, voice.RecordMixFile)); err == nil {
+		if err := addZipFile(zw, dir, voice.RecordMixFile); err != nil {
+			glog.Warningf("export %s/%s: %v", dir, voice.RecordMixFile, err)
+			return
+		}
+	}
+	f, err := zw.Create("transcript.json")
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(turns)
+	if err := zw.Close(); err != nil {
+		glog.Warningf("finish export zip: %v", err)
+	}
+}
+
+// recordingDir resolves a session id to its recording directory. Ids are
+// Doubao session UUIDs, which also keeps the lookup inside the recorder dir.
+func (h *Handler) recordingDir(id string) (string, bool) {
+	rec := h.cfg.Session.Recorder
+	if !rec.Enabled {
+		return "", false
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return "", false
+	}
+	dir := voice.RecordDir(rec, id)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return dir, true
+}
+
+func addZipFile(zw *zip.Writer, dir, name string) error {
+	src, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func readTranscript(path string) ([]transcriptTurn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	turns := []transcriptTurn{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var evt voice.RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			continue
+		}
+		var text voice.TextPayload
+		if evt.Type != "user_text" && evt.Type != "bot_text" {
+			continue
+		}
+		if err := json.Unmarshal(evt.Payload, &text); err != nil || !text.Final {
+			continue
+		}
+		turn := transcriptTurn{Role: "user", Text: text.Text, Time: evt.Time}
+		if evt.Type == "bot_text" {
+			turn.Role, turn.Text = "bot", text.Full
+		}
+		if turn.Text != "" {
+			turns = append(turns, turn)
+		}
+	}
+	return turns, scanner.Err()
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"meow-ai/rpc"
+	"meow-ai/voice"
+)
+
+var errGRPCDone = errors.New("grpc call already finished")
+
+// grpcSendTimeout bounds the wait for a blocked SendMsg when a call ends,
+// matching the websocket write deadline.
+const grpcSendTimeout = 10 * time.Second
+
+// GRPCConverse serves one meowai.Realtime/Converse call. The session starts
+// from the live config and joins the registry like a /ws/realtime session,
+// so reloads, drain, shutdown, admin close and the reaper apply to it. With
+// server.admin_token set the call must carry it as "authorization: Bearer
+// <token>" metadata.
+func (h *Handler) GRPCConverse(stream grpc.ServerStream) error {
+	if !h.grpcAuthorized(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if h.sessions.isDraining() {
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	if voice.AudioMemoryNearLimit() {
+		return status.Error(codes.Unavailable, "server is at its audio memory limit")
+	}
+
+	var first rpc.ConverseRequest
+	if err := stream.RecvMsg(&first); err != nil {
+		return err
+	}
+	if first.Start == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry start")
+	}
+	live := h.live.Load()
+	start := clientStartMessage{
+		Type:       "start",
+		SampleRate: first.Start.SampleRate,
+		Encoding:   first.Start.Encoding,
+	}
+	if err := checkStart(&start, live.cfg); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	session, sessCfg, err := h.startSession(ctx, live, start, false)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	writer := &grpcWriter{stream: stream}
+	active := &activeSession{writer: writer, session: session, cancel: cancel}
+	if !h.sessions.add(active) {
+		session.Close()
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	defer func() {
+		session.Close()
+		h.sessions.remove(active)
+	}()
+
+	recv := &grpcReceiver{stream: stream, session: session}
+	errCh := make(chan error, 3)
+	backendDone := make(chan struct{})
+	go func() {
+		errCh <- recv.run()
+	}()
+	go func() {
+		defer close(backendDone)
+		errCh <- h.pipeBackend(ctx, sessCfg.Session.TTS, writer, session, nil)
+	}()
+	// There is no ready message to acknowledge over gRPC.
+	ackCh := make(chan struct{})
+	close(ackCh)
+	go func() {
+		if err := h.greet(ctx, sessCfg.Session.Dialog, session, ackCh); err != nil {
+			_ = writer.writeJSON(errorMessage(err))
+			errCh <- err
+		}
+	}()
+	// Runs before the deferred session.Close: once the backend returned no
+	// SendMsg is in flight, and once recv is closed no request reaches a
+	// closed session. SendMsg ignores ctx, so a client that stopped reading
+	// is given the websocket write timeout before the stream is abandoned.
+	defer func() {
+		cancel()
+		select {
+		case <-backendDone:
+		case <-time.After(grpcSendTimeout):
+			glog.Warningf("grpc session %s: send still blocked after %s", session.ID(), grpcSendTimeout)
+		}
+		recv.close()
+		writer.finish()
+	}()
+
+	err = <-errCh
+	if errors.Is(err, errStop) {
+		err = awaitReply(ctx, session, errCh)
+		if err == nil {
+			err = drainStop(ctx, session, errCh, sessCfg.Session.StopTimeoutMS)
+		}
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		glog.Warningf("grpc session ended with error: %v", err)
+		return err
+	}
+	if reason := active.reason(); reason != "" {
+		return status.Error(codes.Aborted, reason)
+	}
+	return nil
+}
+
+// grpcAuthorized checks the call's admin token when one is configured.
+func (h *Handler) grpcAuthorized(ctx context.Context) bool {
+	want := h.cfg.Server.AdminToken
+	if want == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcReceiver feeds client requests to the session. frameMu is held while
+// a request is handled; closed is set under it before the session closes.
+type grpcReceiver struct {
+	stream  grpc.ServerStream
+	session *voice.Session
+
+	frameMu sync.Mutex
+	closed  bool
+}
+
+// run handles requests until the client stops or closes its send side,
+// either of which finishes the user's turn and returns errStop.
+func (r *grpcReceiver) run() error {
+	for {
+		var req rpc.ConverseRequest
+		err := r.stream.RecvMsg(&req)
+		if errors.Is(err, io.EOF) {
+			req = rpc.ConverseRequest{Stop: true}
+		} else if err != nil {
+			return err
+		}
+		if err := r.handle(req); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *grpcReceiver) handle(req rpc.ConverseRequest) error {
+	r.frameMu.Lock()
+	defer r.frameMu.Unlock()
+	if r.closed {
+		return errGRPCDone
+	}
+	switch {
+	case req.Stop:
+		return r.finishInput()
+	case len(req.Audio) > 0:
+		if err := r.session.PushAudio(req.Audio); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	case req.Text != "":
+		return r.session.SendText(req.Text)
+	}
+	return nil
+}
+
+// finishInput flushes the client's audio and ends its turn, so the reply
+// to it is awaited before the session stops.
+func (r *grpcReceiver) finishInput() error {
+	if err := r.session.FinishInput(); err != nil && !errors.Is(err, voice.ErrTextMode) {
+		return err
+	}
+	return errStop
+}
+
+func (r *grpcReceiver) close() {
+	r.frameMu.Lock()
+	defer r.frameMu.Unlock()
+	r.closed = true
+}
+
+// grpcWriter sends TTS audio and event frames as ConverseResponse
+// messages. Frames without a payload field, such as errors, travel whole
+// as the event payload.
+type grpcWriter struct {
+	stream grpc.ServerStream
+
+	mu sync.Mutex
+	// done is set by finish, without waiting on a blocked send: the handler
+	// is returning and the stream can no longer be used.
+	done atomic.Bool
+}
+
+func (w *grpcWriter) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	evt := &rpc.Event{Payload: data}
+	_ = json.Unmarshal(fields["type"], &evt.Type)
+	if payload, ok := fields["payload"]; ok {
+		_ = json.Unmarshal(fields["event_id"], &evt.EventID)
+		evt.Payload = payload
+		if string(payload) == "null" {
+			evt.Payload = nil
+		}
+	}
+	return w.send(&rpc.ConverseResponse{Event: evt})
+}
+
+// Write sends a TTS frame, making grpcWriter a voice.AudioSink.
+func (w *grpcWriter) Write(pcm []byte) error {
+	return w.send(&rpc.ConverseResponse{Audio: pcm})
+}
+
+// Close is a no-op: the stream ends when GRPCConverse returns.
+func (w *grpcWriter) Close() error {
+	return nil
+}
+
+// send serializes SendMsg, which gRPC does not allow concurrently.
+func (w *grpcWriter) send(msg *rpc.ConverseResponse) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done.Load() {
+		return errGRPCDone
+	}
+	return w.stream.SendMsg(msg)
+}
+
+func (w *grpcWriter) finish() {
+	w.done.Store(true)
+}
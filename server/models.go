@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"meow-ai/config"
+)
+
+// modelInfo is one entry of GET /models. Known is false for a configured
+// model missing from the capability table, whose flags are then unknown
+// rather than false.
+type modelInfo struct {
+	Model string `json:"model"`
+	Known bool   `json:"known"`
+	config.ModelCapabilities
+}
+
+// handleModels lists the dialog models a start message may select, with
+// their capabilities, so a UI can disable features the model lacks.
+func (h *Handler) handleModels(w http.ResponseWriter, _ *http.Request) {
+	dialog := h.live.Load().cfg.Session.Dialog
+	models := []modelInfo{}
+	for _, model := range dialog.Models() {
+		caps, known := config.LookupModel(model)
+		models = append(models, modelInfo{Model: model, Known: known, ModelCapabilities: caps})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"default": dialog.Extra.Model,
+		"models":  models,
+	})
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+
+	"meow-ai/config"
+	"meow-ai/voice"
+	"meow-ai/volc"
+)
+
+// /ws/mux carries several sessions over one websocket, for clients that run
+// more than one conversation at a time. Every frame names its sub-session:
+//
+//   - Text frames are the usual control messages with an extra "session"
+//     field. A start for an unknown session opens it and is answered with a
+//     ready tagged with the same id; events from the server are tagged too.
+//   - Binary frames are prefixed with the id: one length byte, then the id
+//     bytes, then the audio. Bot audio is framed the same way.
+//   - A stop ends only its own sub-session. When a sub-session ends for any
+//     reason the server sends {type: "session_end", session, reason} and the
+//     id may be reused. Closing the websocket ends every sub-session.
+//
+// At most server.mux_max_sessions sub-sessions may be open at once. Opening
+// one blocks the connection's reader until it is ready, like the start
+// handshake on /ws/realtime, so audio for the others waits rather than drops.
+
+var muxSessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+type muxEnvelope struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+}
+
+// muxConn is the state of one /ws/mux connection.
+type muxConn struct {
+	h      *Handler
+	conn   *websocket.Conn
+	writer *wsWriter
+	ctx    context.Context
+
+	mu   sync.Mutex
+	subs map[string]*muxSession
+	wg   sync.WaitGroup
+}
+
+// muxSession is one sub-session of a muxConn.
+type muxSession struct {
+	id     string
+	active *activeSession
+	front  *frontend
+	// errCh ends the sub-session; the first error wins.
+	errCh chan error
+	// frameMu is held while a frame is handled; closed is set under it
+	// before the session closes, so no frame reaches a closed session.
+	frameMu sync.Mutex
+	closed  bool
+}
+
+// stop ends the sub-session with err unless it is already ending.
+func (s *muxSession) stop(err error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+}
+
+// muxWriter tags everything it sends with its sub-session id.
+type muxWriter struct {
+	conn *wsWriter
+	id   string
+}
+
+func (w *muxWriter) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) < 2 || data[0] != '{' {
+		return fmt.Errorf("mux: cannot tag %T with a session id", v)
+	}
+	id, _ := json.Marshal(w.id)
+	tagged := make([]byte, 0, len(data)+len(id)+12)
+	tagged = append(tagged, `{"session":`...)
+	tagged = append(tagged, id...)
+	if len(data) > 2 {
+		tagged = append(tagged, ',')
+	}
+	tagged = append(tagged, data[1:]...)
+	return w.conn.writeMessage(websocket.TextMessage, tagged)
+}
+
+// Write sends a TTS frame behind the sub-session's id prefix.
+func (w *muxWriter) Write(pcm []byte) error {
+	frame := make([]byte, 0, 1+len(w.id)+len(pcm))
+	frame = append(frame, byte(len(w.id)))
+	frame = append(frame, w.id...)
+	frame = append(frame, pcm...)
+	return w.conn.writeBinary(frame)
+}
+
+// Close is a no-op: the connection is owned by handleMux.
+func (w *muxWriter) Close() error {
+	return nil
+}
+
+// splitMuxFrame splits a binary frame into its session id and payload.
+func splitMuxFrame(data []byte) (string, []byte, error) {
+	if len(data) == 0 {
+		return "", nil, errors.New("binary frame is missing its session id prefix")
+	}
+	n := int(data[0])
+	if n == 0 || len(data) < 1+n {
+		return "", nil, fmt.Errorf("binary frame has a bad session id length %d", n)
+	}
+	return string(data[1 : 1+n]), data[1+n:], nil
+}
+
+func (h *Handler) handleMux(w http.ResponseWriter, r *http.Request) {
+	if h.sessions.isDraining() {
+		h.rejectDraining(w, r)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Errorf("upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(h.cfg.Server.MaxMessageBytes)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	m := &muxConn{
+		h:      h,
+		conn:   conn,
+		writer: &wsWriter{conn: conn},
+		ctx:    ctx,
+		subs:   make(map[string]*muxSession),
+	}
+	err = m.read()
+	cancel()
+	m.wg.Wait()
+
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		closeConn(conn, websocket.CloseMessageTooBig, "message too big")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		closeConn(conn, websocket.CloseGoingAway, "idle timeout")
+	default:
+		glog.Warningf("mux connection ended with error: %v", err)
+		closeConn(conn, websocket.CloseInternalServerErr, "mux error")
+	}
+}
+
+// read routes client frames to their sub-sessions until the connection
+// fails.
+func (m *muxConn) read() error {
+	for {
+		if err := m.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
+			return err
+		}
+		mt, data, err := m.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch mt {
+		case websocket.BinaryMessage:
+			id, payload, err := splitMuxFrame(data)
+			if err != nil {
+				if err := m.writer.writeJSON(errorMessage(&controlError{code: "malformed_message", msg: err.Error()})); err != nil {
+					return err
+				}
+				continue
+			}
+			sub := m.get(id)
+			if sub == nil {
+				glog.V(1).Infof("mux: drop audio for unknown session %q", id)
+				continue
+			}
+			m.route(sub, mt, payload)
+		case websocket.TextMessage:
+			if err := m.control(data); err != nil {
+				return err
+			}
+		default:
+			glog.Infof("ignore message type=%d", mt)
+		}
+	}
+}
+
+// control handles a text frame: a start for a new id opens a sub-session,
+// anything else goes to the named sub-session's frontend.
+func (m *muxConn) control(data []byte) error {
+	var env muxEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return m.writer.writeJSON(errorMessage(&controlError{code: "malformed_message", msg: fmt.Sprintf("控制消息不是合法的 JSON: %v", err)}))
+	}
+	if !muxSessionIDPattern.MatchString(env.Session) {
+		return m.writer.writeJSON(errorMessage(&controlError{code: "bad_session_id", msg: fmt.Sprintf("session 字段 %q 格式不正确", env.Session)}))
+	}
+	if sub := m.get(env.Session); sub != nil {
+		m.route(sub, websocket.TextMessage, data)
+		return nil
+	}
+	out := &muxWriter{conn: m.writer, id: env.Session}
+	if env.Type != "start" {
+		return out.writeJSON(errorMessage(&controlError{code: "unknown_session", msg: fmt.Sprintf("会话 %q 不存在或已结束", env.Session)}))
+	}
+	if err := m.open(env.Session, data); err != nil {
+		return out.writeJSON(errorMessage(err))
+	}
+	return nil
+}
+
+// route hands a frame to a sub-session's frontend, ending the sub-session
+// on stop or a fatal error.
+func (m *muxConn) route(sub *muxSession, mt int, data []byte) {
+	sub.frameMu.Lock()
+	defer sub.frameMu.Unlock()
+	if sub.closed {
+		return
+	}
+	if err := sub.front.handleFrame(mt, data); err != nil {
+		sub.stop(err)
+	}
+}
+
+func (m *muxConn) get(id string) *muxSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.subs[id]
+}
+
+// open starts a sub-session from its start message.
+func (m *muxConn) open(id string, data []byte) error {
+	m.mu.Lock()
+	open := len(m.subs)
+	m.mu.Unlock()
+	if limit := m.h.cfg.Server.MuxMaxSessions; open >= limit {
+		return &controlError{code: "too_many_sessions", msg: fmt.Sprintf("每个连接最多同时打开 %d 个会话", limit)}
+	}
+	if voice.AudioMemoryNearLimit() {
+		return errors.New("server is at its audio memory limit")
+	}
+
+	if len(data) > startMessageLimit {
+		return errStartTooLarge
+	}
+	live := m.h.live.Load()
+	var start clientStartMessage
+	if err := json.Unmarshal(data, &start); err != nil {
+		return err
+	}
+	if err := checkStart(&start, live.cfg); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	session, sessCfg, err := m.h.startSession(ctx, live, start, false)
+	if err != nil {
+		cancel()
+		return err
+	}
+	writer := &muxWriter{conn: m.writer, id: id}
+	active := &activeSession{writer: writer, session: session, cancel: cancel}
+	if !m.h.sessions.add(active) {
+		session.Close()
+		cancel()
+		return errors.New("server is shutting down")
+	}
+
+	ackCh := make(chan struct{})
+	replayCh := make(chan struct{}, 1)
+	sub := &muxSession{
+		id:     id,
+		active: active,
+		front: &frontend{
+			writer:        writer,
+			session:       session,
+			voices:        m.h.voices,
+			ackCh:         ackCh,
+			replayCh:      replayCh,
+			emptyFinishes: sessCfg.Session.ASR.EmptyFrameFinishes,
+			integrity:     sessCfg.Session.AudioIntegrity,
+		},
+		errCh: make(chan error, 1),
+	}
+	m.mu.Lock()
+	m.subs[id] = sub
+	m.mu.Unlock()
+
+	if err := writer.writeJSON(m.h.readyMessage(session, sessCfg, start.ProtocolVersion)); err != nil {
+		sub.stop(err)
+	}
+	m.wg.Add(1)
+	go m.run(ctx, sub, sessCfg.Session, replayCh, ackCh)
+	return nil
+}
+
+// run drives a sub-session until it stops, its backend fails or the
+// connection closes, then tears it down and tells the client.
+func (m *muxConn) run(ctx context.Context, sub *muxSession, cfg config.SessionConfig, replayCh, ackCh <-chan struct{}) {
+	defer m.wg.Done()
+	session := sub.active.session
+	go func() {
+		sub.stop(m.h.pipeBackend(ctx, cfg.TTS, sub.active.writer, session, replayCh))
+	}()
+	go func() {
+		if err := m.h.greet(ctx, cfg.Dialog, session, ackCh); err != nil {
+			_ = sub.active.writer.writeJSON(errorMessage(err))
+			sub.stop(err)
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-sub.errCh:
+	case <-ctx.Done():
+	}
+	if errors.Is(err, errStop) {
+		err = drainStop(ctx, session, sub.errCh, cfg.StopTimeoutMS)
+	}
+	sub.active.cancel()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		glog.Warningf("mux session %s ended with error: %v", sub.id, err)
+	}
+	m.mu.Lock()
+	delete(m.subs, sub.id)
+	m.mu.Unlock()
+	sub.frameMu.Lock()
+	sub.closed = true
+	sub.frameMu.Unlock()
+	session.Close()
+	m.h.sessions.remove(sub.active)
+
+	if m.ctx.Err() != nil {
+		return // the connection is gone
+	}
+	var rl *volc.RateLimitError
+	if errors.As(session.Err(), &rl) {
+		_ = sub.active.writer.writeJSON(errorMessage(rl))
+	}
+	_, reason := closeStatus(err, sub.active)
+	_ = sub.active.writer.writeJSON(map[string]any{"type": "session_end", "reason": reason})
+}
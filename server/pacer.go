@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"meow-ai/config"
+)
+
+// pacer schedules TTS frames at playback rate so bursts from Doubao reach
+// the client smoothly. A nil pacer releases frames immediately.
+type pacer struct {
+	bytesPerSec float64
+	lead        time.Duration
+	next        time.Time
+}
+
+func newPacer(tts config.TTSConfig) *pacer {
+	if !tts.Pacing.Enabled {
+		return nil
+	}
+	return &pacer{
+		bytesPerSec: float64(tts.AudioConfig.BytesPerSecond()),
+		lead:        time.Duration(tts.Pacing.LeadMS) * time.Millisecond,
+	}
+}
+
+// wait blocks until a frame of n bytes may be sent, keeping at most lead of
+// audio queued ahead of real time on the client.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	if delay := p.next.Sub(now) - p.lead; delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / p.bytesPerSec * float64(time.Second)))
+	return nil
+}
+
+// reset forgets the schedule after the client flushed its playback buffer.
+func (p *pacer) reset() {
+	if p == nil {
+		return
+	}
+	p.next = time.Time{}
+}
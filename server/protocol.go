@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"meow-ai/config"
+	"meow-ai/voice"
+)
+
+// errProtocolVersion tags start messages asking for an unsupported version.
+var errProtocolVersion = errors.New("unsupported protocol version")
+
+// Frontend protocol versions. A start message without protocolVersion is
+// treated as version 1.
+//
+//	1: raw Doubao events plus the synthesized user_text/bot_text events.
+//	2: adds audio_flush, degraded, rate_limited, replay_last and the opt-in
+//	   thinking subscription.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 2
+)
+
+// negotiateVersion returns the version to speak with a client that asked for
+// requested, or an error when it is outside the supported range.
+func negotiateVersion(requested int) (int, error) {
+	if requested == 0 {
+		return minProtocolVersion, nil
+	}
+	if requested < minProtocolVersion || requested > maxProtocolVersion {
+		return 0, fmt.Errorf("%w: 不支持的协议版本 %d，支持范围 %d-%d", errProtocolVersion, requested, minProtocolVersion, maxProtocolVersion)
+	}
+	return requested, nil
+}
+
+// features lists the optional behaviours available to a client on version,
+// given the server config, so it can adapt without probing.
+func (h *Handler) features(cfg *config.Config, version int) []string {
+	features := []string{}
+	if cfg.Session.Dialog.Extra.InputMod == voice.InputModText {
+		features = append(features, "text_input")
+	} else {
+		features = append(features, "audio_input", "text_input")
+	}
+	if cfg.Session.TTS.AudioEnabled() {
+		features = append(features, "audio_output")
+	}
+	if cfg.Session.TTS.Pacing.Enabled {
+		features = append(features, "pacing")
+	}
+	if cfg.Session.Recorder.Enabled {
+		features = append(features, "recording")
+	}
+	if version >= 2 {
+		features = append(features, "replay_last", "thinking")
+	}
+	return features
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+
+	"meow-ai/config"
+)
+
+// rechunker reframes TTS audio to the client's requested frame size
+// (session.tts.output_frame_ms or output_frame_bytes), splitting Doubao's
+// frames and coalescing small ones. Bytes that do not fill a frame are kept
+// for the next one; pipeBackend sends them as a short tail frame once audio
+// pauses for a frame's duration or the session ends, so no samples are lost.
+// A nil rechunker passes frames through.
+type rechunker struct {
+	size int
+	// linger is how long a partial frame waits for more audio.
+	linger time.Duration
+	buf    []byte
+}
+
+func newRechunker(tts config.TTSConfig) *rechunker {
+	size := tts.FrameBytes()
+	if size == 0 {
+		return nil
+	}
+	linger := time.Duration(float64(size) / float64(tts.AudioConfig.BytesPerSecond()) * float64(time.Second))
+	return &rechunker{size: size, linger: max(linger, 10*time.Millisecond)}
+}
+
+// push adds data and returns the complete frames now available.
+func (r *rechunker) push(data []byte) [][]byte {
+	if r == nil {
+		return [][]byte{data}
+	}
+	if len(r.buf) == 0 && len(data) == r.size {
+		return [][]byte{data}
+	}
+	buf := append(r.buf, data...)
+	var frames [][]byte
+	for len(buf) >= r.size {
+		frames = append(frames, buf[:r.size:r.size])
+		buf = buf[r.size:]
+	}
+	// The frames alias buf, so the tail moves to its own array.
+	r.buf = append([]byte(nil), buf...)
+	return frames
+}
+
+// flush returns the partial frame, if any.
+func (r *rechunker) flush() []byte {
+	if r == nil || len(r.buf) == 0 {
+		return nil
+	}
+	tail := r.buf
+	r.buf = nil
+	return tail
+}
+
+// reset drops the partial frame after the client flushed its playback.
+func (r *rechunker) reset() {
+	if r != nil {
+		r.buf = nil
+	}
+}
+
+// lingerTimer fires when a pending partial frame should be sent; it is nil
+// when nothing is pending.
+func (r *rechunker) lingerTimer() <-chan time.Time {
+	if r == nil || len(r.buf) == 0 {
+		return nil
+	}
+	return time.After(r.linger)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/voice"
+)
+
+const (
+	selftestFrame    = 40 * time.Millisecond
+	selftestDuration = 3 * time.Second
+)
+
+// handleSelftest streams a sine tone over the realtime protocol, bypassing
+// Doubao, so client playback and binary framing can be checked in isolation.
+// Optional query parameters: freq (Hz, default 440) and ms (default 3000).
+func (h *Handler) handleSelftest(w http.ResponseWriter, r *http.Request) {
+	freq := 440.0
+	if v, err := strconv.ParseFloat(r.URL.Query().Get("freq"), 64); err == nil && v > 0 {
+		freq = v
+	}
+	duration := selftestDuration
+	if v, err := strconv.Atoi(r.URL.Query().Get("ms")); err == nil && v > 0 && v <= 60000 {
+		duration = time.Duration(v) * time.Millisecond
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Errorf("upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	writer := &wsWriter{conn: conn}
+
+	out := h.live.Load().cfg.Session.TTS.AudioConfig
+	frameSamples := int(selftestFrame.Seconds() * float64(out.SampleRate))
+	totalSamples := int(duration.Seconds() * float64(out.SampleRate))
+	frames := voice.ToneFrames(out.SampleRate, out.Format, freq, totalSamples, frameSamples)
+
+	if err := writer.writeJSON(map[string]any{"type": "ready", "selftest": true}); err != nil {
+		return
+	}
+	ticker := time.NewTicker(selftestFrame)
+	defer ticker.Stop()
+	for _, frame := range frames {
+		if err := writer.writeBinary(frame); err != nil {
+			glog.Warningf("selftest write: %v", err)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	_ = writer.writeJSON(map[string]any{"type": "selftest_done", "frames": len(frames)})
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+
+	"meow-ai/metrics"
+	"meow-ai/voice"
+)
+
+// Reasons the server ends a session on its own initiative.
+const (
+	endShutdown   = "server_shutdown"
+	endTerminated = "terminated"
+	endReaped     = "reaped"
+)
+
+// activeSession is a live /ws/realtime connection tracked by the Handler.
+type activeSession struct {
+	// conn is nil for /ws/mux sub-sessions, which share their connection.
+	conn    *websocket.Conn
+	writer  clientWriter
+	session *voice.Session
+	cancel  context.CancelFunc
+
+	// endReason is set once when the server ends the session.
+	endReason atomic.Value
+}
+
+// end notifies the client with an event of type reason and cancels the
+// session, unblocking pipeFrontend's pending read so the handler tears down.
+func (s *activeSession) end(reason string) {
+	if !s.endReason.CompareAndSwap(nil, reason) {
+		return
+	}
+	_ = s.writer.writeJSON(map[string]any{"type": reason})
+	s.cancel()
+	if s.conn != nil {
+		_ = s.conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (s *activeSession) reason() string {
+	reason, _ := s.endReason.Load().(string)
+	return reason
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*activeSession
+	// draining refuses new sessions, set by Drain and Shutdown; shutdown is
+	// only set by Shutdown.
+	draining bool
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*activeSession)}
+}
+
+// add registers a session under its Doubao session ID unless the registry is
+// draining.
+func (r *sessionRegistry) add(s *activeSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.sessions[s.session.ID()] = s
+	r.wg.Add(1)
+	return true
+}
+
+func (r *sessionRegistry) remove(s *activeSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := s.session.ID()
+	if r.sessions[id] != s {
+		return
+	}
+	delete(r.sessions, id)
+	r.wg.Done()
+}
+
+func (r *sessionRegistry) get(id string) (*activeSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+func (r *sessionRegistry) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// Drain stops accepting new sessions while the active ones carry on until
+// they end or Shutdown ends them. /readyz reports 503 from then on, so a
+// load balancer sends new clients to other instances during a rolling
+// deploy. Draining cannot be undone without a restart.
+func (h *Handler) Drain() {
+	r := h.sessions
+	r.mu.Lock()
+	wasDraining := r.draining
+	r.draining = true
+	active := len(r.sessions)
+	r.mu.Unlock()
+	if !wasDraining {
+		glog.Infof("draining: refusing new sessions, %d still active", active)
+	}
+}
+
+// Shutdown stops accepting new sessions, notifies every active client with a
+// server_shutdown event and ends its session, then waits for the handlers to
+// finish their teardown (Session.Close) or for ctx to expire.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	r := h.sessions
+	r.mu.Lock()
+	wasShutdown := r.shutdown
+	r.draining, r.shutdown = true, true
+	active := make([]*activeSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		active = append(active, s)
+	}
+	r.mu.Unlock()
+	if !wasShutdown {
+		close(h.stopReaper)
+	}
+
+	if pool := h.live.Load().pool; pool != nil {
+		pool.Close()
+	}
+	glog.Infof("shutting down %d active sessions", len(active))
+	for _, s := range active {
+		s.end(endShutdown)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reap force-closes sessions idle for longer than maxIdle, checking every
+// quarter of it until Shutdown. A reaped session points at a missing timeout
+// somewhere, so it is logged loudly with what the session was doing.
+func (h *Handler) reap(maxIdle time.Duration) {
+	ticker := time.NewTicker(maxIdle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.stopReaper:
+			return
+		}
+		h.sessions.mu.Lock()
+		var idle []*activeSession
+		for _, s := range h.sessions.sessions {
+			if s.session.IdleFor() > maxIdle {
+				idle = append(idle, s)
+			}
+		}
+		h.sessions.mu.Unlock()
+		for _, s := range idle {
+			glog.Errorf("reaping idle session %s: idle %s, err=%v, stats=%+v",
+				s.session.ID(), s.session.IdleFor().Round(time.Second), s.session.Err(), s.session.Stats())
+			metrics.SessionsReaped.Add(1)
+			s.end(endReaped)
+		}
+	}
+}
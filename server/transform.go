@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"meow-ai/config"
+)
+
+// EventTransformer reshapes an event frame on its way to the client, after
+// pipeBackend built it as {type, event_id, payload}. It may modify and
+// return msg or build a new map; returning nil drops the event.
+type EventTransformer func(msg map[string]any) map[string]any
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]EventTransformer{
+		"identity":   identityTransform,
+		"flatten":    flattenTransform,
+		"typed_only": typedOnlyTransform,
+	}
+)
+
+// RegisterEventTransformer makes t selectable as server.event_transform.name.
+// Call it before NewHandler.
+func RegisterEventTransformer(name string, t EventTransformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[name] = t
+}
+
+// newEventTransformer builds the transformer cfg selects. An unknown name
+// is logged and treated as identity so a typo does not take the server down.
+func newEventTransformer(cfg config.EventTransformConfig) EventTransformer {
+	name := cfg.Name
+	if name == "" {
+		name = "identity"
+	}
+	transformersMu.RLock()
+	t, ok := transformers[name]
+	transformersMu.RUnlock()
+	if !ok {
+		glog.Errorf("unknown server.event_transform.name %q, using identity", name)
+		t = identityTransform
+	}
+	if len(cfg.Rename) == 0 {
+		return t
+	}
+	return func(msg map[string]any) map[string]any {
+		msg = t(msg)
+		if msg == nil {
+			return nil
+		}
+		return renameFields(msg, cfg.Rename)
+	}
+}
+
+func identityTransform(msg map[string]any) map[string]any {
+	return msg
+}
+
+// flattenTransform inlines the fields of an object payload into the frame,
+// so {type, payload: {text}} becomes {type, text}. Fields the frame already
+// has win; non-object payloads are left under payload.
+func flattenTransform(msg map[string]any) map[string]any {
+	raw, ok := msg["payload"].(json.RawMessage)
+	if !ok {
+		return msg
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return msg
+	}
+	delete(msg, "payload")
+	for k, v := range fields {
+		if _, taken := msg[k]; !taken {
+			msg[k] = v
+		}
+	}
+	return msg
+}
+
+// typedOnlyTransform drops raw Doubao events, leaving only the typed events
+// the server synthesizes (user_text, bot_text, ...), for clients that do
+// not parse Doubao payloads.
+func typedOnlyTransform(msg map[string]any) map[string]any {
+	if msg["type"] == "event" {
+		return nil
+	}
+	return msg
+}
+
+func renameFields(msg map[string]any, rename map[string]string) map[string]any {
+	out := make(map[string]any, len(msg))
+	for k, v := range msg {
+		if to, ok := rename[k]; ok {
+			k = to
+		}
+		out[k] = v
+	}
+	return out
+}
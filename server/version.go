@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/golang/glog"
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X meow-ai/server.Version=v1.0.0 -X meow-ai/server.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+func (h *Handler) handleVersion(w http.ResponseWriter, _ *http.Request) {
+	summary, err := h.live.Load().cfg.Summary()
+	if err != nil {
+		glog.Errorf("build config summary: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"version":    Version,
+		"commit":     Commit,
+		"go_version": runtime.Version(),
+		"config":     summary,
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"meow-ai/voices"
+)
+
+const maxVoiceUploadBytes = 11 << 20
+
+// handleCreateVoice accepts a multipart form with a "name" field and an
+// "audio" file, clones it and returns the speaker ID. An existing name is
+// rejected with 409 unless "overwrite" is true.
+func (h *Handler) handleCreateVoice(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxVoiceUploadBytes)
+	if err := r.ParseMultipartForm(maxVoiceUploadBytes); err != nil {
+		http.Error(w, "invalid multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	file, fh, err := r.FormFile("audio")
+	if err != nil {
+		http.Error(w, "audio file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	audio, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "read audio: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite := false
+	if v := r.FormValue("overwrite"); v != "" {
+		if overwrite, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "overwrite must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(fh.Filename)), ".")
+	}
+
+	speakerID, err := h.cloner.Clone(r.Context(), name, audio, format, overwrite)
+	if errors.Is(err, voices.ErrVoiceExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		glog.Warningf("clone voice %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"name":       name,
+		"speaker_id": speakerID,
+	})
+}
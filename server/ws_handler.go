@@ -4,129 +4,579 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
 
 	"meow-ai/config"
+	"meow-ai/metrics"
 	"meow-ai/voice"
+	"meow-ai/voices"
+	"meow-ai/volc"
 )
 
 type Handler struct {
+	// cfg is the startup config. Server-level settings (listeners, routes,
+	// limits, admin token) always come from it.
 	cfg      *config.Config
 	upgrader websocket.Upgrader
+	sessions *sessionRegistry
+
+	// live is the config new sessions start with, swapped by
+	// POST /admin/reload.
+	live       atomic.Pointer[liveConfig]
+	configPath string
+	loadOpts   []config.LoadOption
+
+	voices *voices.Store
+	cloner *voices.Cloner
+
+	// transform reshapes event frames, see server.event_transform.
+	transform EventTransformer
+
+	stopReaper chan struct{}
+}
+
+// liveConfig is a config together with the session pool started for it.
+type liveConfig struct {
+	cfg *config.Config
+	// pool is nil unless session.pool.size is set.
+	pool *voice.ClientPool
 }
 
 func NewHandler(cfg *config.Config) *Handler {
-	return &Handler{
-		cfg: cfg,
+	h := &Handler{
+		cfg:        cfg,
+		sessions:   newSessionRegistry(),
+		stopReaper: make(chan struct{}),
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			EnableCompression: cfg.Server.EnableCompression,
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		},
 	}
+	if cfg.VoiceClone.Enabled {
+		store, err := voices.NewStore(cfg.VoiceClone.StorePath)
+		if err != nil {
+			glog.Errorf("voice cloning disabled: %v", err)
+		} else {
+			h.voices = store
+			h.cloner = voices.NewCloner(cfg.API, cfg.VoiceClone, store)
+		}
+	}
+	h.transform = newEventTransformer(cfg.Server.EventTransform)
+	voice.SetAudioMemoryLimit(cfg.Server.MaxAudioMemoryBytes)
+	if cfg.Server.ReapIdleMS > 0 {
+		go h.reap(time.Duration(cfg.Server.ReapIdleMS) * time.Millisecond)
+	}
+	h.live.Store(h.newLiveConfig(cfg))
+	return h
+}
+
+// SetEventTransformer replaces the transformer selected by
+// server.event_transform, for embedders that reshape events in Go.
+func (h *Handler) SetEventTransformer(t EventTransformer) {
+	h.transform = t
+}
+
+// SetConfigPath records the source the config was loaded from (see
+// config.Load), and the options it was loaded with, enabling POST
+// /admin/reload when an admin token is configured.
+func (h *Handler) SetConfigPath(path string, opts ...config.LoadOption) {
+	h.configPath = path
+	h.loadOpts = opts
+}
+
+func (h *Handler) newLiveConfig(cfg *config.Config) *liveConfig {
+	live := &liveConfig{cfg: cfg}
+	if cfg.Session.Pool.Size > 0 {
+		poolCfg, err := h.sessionConfig(cfg, clientStartMessage{})
+		if err != nil {
+			glog.Errorf("session pool disabled: %v", err)
+		} else {
+			live.pool = voice.NewClientPool(poolCfg)
+		}
+	}
+	return live
 }
 
 func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/ws/realtime", h.handleRealtime)
+	if h.cfg.Server.ASROnlyEndpoint {
+		mux.HandleFunc("/ws/asr", h.handleASROnly)
+	}
+	if h.cfg.Server.MuxMaxSessions > 0 {
+		mux.HandleFunc("/ws/mux", h.handleMux)
+	}
+	if h.cfg.Server.ConverseTimeoutMS > 0 {
+		mux.HandleFunc("POST /converse", h.handleConverse)
+	}
+	mux.HandleFunc("GET /version", h.handleVersion)
+	mux.HandleFunc("GET /models", h.handleModels)
+	mux.Handle("GET /metrics", metrics.Handler())
+	if h.cfg.Server.AdminToken != "" {
+		mux.HandleFunc("POST /sessions/{id}/close", h.requireAdmin(h.handleCloseSession))
+		if h.cfg.Session.EventLogSize > 0 {
+			mux.HandleFunc("GET /sessions/{id}/events", h.requireAdmin(h.handleSessionEvents))
+		}
+		if h.cfg.Session.Recorder.Enabled {
+			mux.HandleFunc("GET /sessions/{id}/export", h.requireAdmin(h.handleExport))
+		}
+		if h.cfg.Session.Captions {
+			mux.HandleFunc("GET /sessions/{id}/{format}", h.requireAdmin(h.handleCaptions))
+		}
+		if h.configPath != "" {
+			mux.HandleFunc("POST /admin/reload", h.requireAdmin(h.handleReload))
+		}
+		mux.HandleFunc("POST /admin/drain", h.requireAdmin(h.handleDrain))
+		if h.cloner != nil {
+			mux.HandleFunc("POST /voices", h.requireAdmin(h.handleCreateVoice))
+		}
+	} else if h.cloner != nil {
+		glog.Warningf("voice_clone is enabled but POST /voices needs server.admin_token")
+	}
+	if h.cfg.Server.Debug {
+		mux.HandleFunc("GET /selftest", h.handleSelftest)
+	}
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	// /readyz fails once the instance drains, while /healthz keeps passing
+	// so the orchestrator lets active sessions finish.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if h.sessions.isDraining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready"))
+	})
+}
+
+// rejectDraining turns a websocket client away while the instance drains.
+// The upgrade still completes so the client gets a {type: "draining"} frame
+// and a try-again-later close it can act on, rather than a bare HTTP 503.
+func (h *Handler) rejectDraining(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Errorf("upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	writer := &wsWriter{conn: conn}
+	_ = writer.writeJSON(map[string]any{"type": "draining", "message": "server is draining, connect to another instance"})
+	closeConn(conn, websocket.CloseTryAgainLater, "draining")
 }
 
+// Audio ordering contract for frontend clients:
+//
+//   - Audio sent before the start message is rejected: the server replies
+//     with an error (code "audio_before_start") and closes the connection.
+//   - Audio sent after start but before ready is not lost. The server does
+//     not read the socket while it opens the Doubao session, so those frames
+//     wait in the connection and are processed, in order, right after ready.
+//   - If the session fails to start, the client gets an error instead of
+//     ready and any queued audio is discarded with the connection.
+//
+// Clients that want no buffering should simply wait for ready.
+var errAudioBeforeStart = errors.New("首条消息必须是 {type:\"start\"}，不能先发送音频")
+
+// startMessageLimit bounds the start message, far below
+// server.max_message_bytes which is sized for audio frames. Only this much of
+// an oversized first frame is read into memory.
+const startMessageLimit = 16 << 10
+
+var errStartTooLarge = &controlError{code: "start_message_too_large", msg: fmt.Sprintf("start 消息不能超过 %d 字节", startMessageLimit)}
+
 type clientStartMessage struct {
 	Type       string `json:"type"`
 	SampleRate int    `json:"sampleRate"`
 	Encoding   string `json:"encoding"`
+	// DialogID resumes a previous dialog, overriding session.dialog.dialog_id.
+	DialogID string `json:"dialogId"`
+	// InputMod optionally declares the client's input mode; it must match
+	// session.dialog.extra.input_mod.
+	InputMod string `json:"inputMod"`
+	// Subscribe opts in to optional event types, currently only "thinking".
+	Subscribe []string `json:"subscribe"`
+	// ProtocolVersion is the frontend protocol the client speaks; see
+	// negotiateVersion.
+	ProtocolVersion int `json:"protocolVersion"`
+	// LowRate tells the server a sampleRate below 16000 is intentional, for
+	// example to save uplink bandwidth; see voice.LowSampleRates.
+	LowRate bool `json:"lowRate"`
+	// OutputMod optionally declares what the client plays: "audio" is
+	// rejected when session.tts.enabled is false, "text" always works.
+	OutputMod string `json:"outputMod"`
+	// EmptyFrameFinishes overrides session.asr.empty_frame_finishes.
+	EmptyFrameFinishes *bool `json:"emptyFrameFinishes"`
+	// EndSmoothWindowMS overrides session.asr.extra.end_smooth_window_ms,
+	// e.g. longer for dictation and shorter for quick chat.
+	EndSmoothWindowMS *int `json:"endSmoothWindowMs"`
+	// MaxResponseTokens overrides session.dialog.max_response_tokens, e.g.
+	// short replies for a voice-only device; 0 lifts the limit.
+	MaxResponseTokens *int `json:"maxResponseTokens"`
+	// OutputFrameMS or OutputFrameBytes override session.tts.output_frame_ms
+	// and output_frame_bytes; setting one clears the other.
+	OutputFrameMS    *int `json:"outputFrameMs"`
+	OutputFrameBytes *int `json:"outputFrameBytes"`
+	// Model overrides session.dialog.extra.model with one of GET /models.
+	Model string `json:"model"`
+	// Metadata fills the session.dialog.system_role and personal_greeting
+	// templates, e.g. {"UserName": "小明"} for {{.UserName}}.
+	Metadata map[string]string `json:"metadata"`
 }
 
-type clientControlMessage struct {
-	Type string `json:"type"`
+// outputFrame returns the output frame size the session uses, ms or bytes,
+// after the start message's overrides.
+func (m clientStartMessage) outputFrame(tts config.TTSConfig) (ms, bytes int) {
+	ms, bytes = tts.OutputFrameMS, tts.OutputFrameBytes
+	if m.OutputFrameMS != nil {
+		ms, bytes = *m.OutputFrameMS, 0
+	}
+	if m.OutputFrameBytes != nil {
+		if m.OutputFrameMS == nil {
+			ms = 0
+		}
+		bytes = *m.OutputFrameBytes
+	}
+	return ms, bytes
 }
 
+// sessionOptions maps the start message's subscriptions to session options.
+func (m clientStartMessage) sessionOptions() []voice.Option {
+	var opts []voice.Option
+	for _, topic := range m.Subscribe {
+		switch topic {
+		case "thinking":
+			opts = append(opts, voice.WithThinking())
+		default:
+			glog.V(1).Infof("ignore unknown subscription %q", topic)
+		}
+	}
+	return opts
+}
+
+var dialogIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
 func (h *Handler) handleRealtime(w http.ResponseWriter, r *http.Request) {
+	h.serveRealtime(w, r, false)
+}
+
+// handleASROnly speaks the realtime protocol but the session only returns
+// recognition results: no greeting, no bot text and no audio.
+func (h *Handler) handleASROnly(w http.ResponseWriter, r *http.Request) {
+	h.serveRealtime(w, r, true)
+}
+
+func (h *Handler) serveRealtime(w http.ResponseWriter, r *http.Request, asrOnly bool) {
+	if h.sessions.isDraining() {
+		h.rejectDraining(w, r)
+		return
+	}
+	if voice.AudioMemoryNearLimit() {
+		http.Error(w, "server is at its audio memory limit", http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		glog.Errorf("upgrade websocket: %v", err)
 		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(h.cfg.Server.MaxMessageBytes)
 
-	startMsg, err := h.readStart(conn)
+	live := h.live.Load()
+	startMsg, err := h.readStart(conn, live.cfg)
 	if err != nil {
 		h.writeError(conn, err)
 		return
 	}
 
-	format := voice.InputFormat{
-		SampleRate: startMsg.SampleRate,
-		Encoding:   voice.Encoding(startMsg.Encoding),
-	}
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	session, err := voice.NewSession(ctx, h.cfg, format)
+	session, sessCfg, err := h.startSession(ctx, live, startMsg, asrOnly)
 	if err != nil {
 		h.writeError(conn, err)
 		return
 	}
-	defer session.Close()
 
 	writer := &wsWriter{conn: conn}
-	if err := writer.writeJSON(map[string]any{"type": "ready"}); err != nil {
+	active := &activeSession{conn: conn, writer: writer, session: session, cancel: cancel}
+	if !h.sessions.add(active) {
+		session.Close()
+		h.writeError(conn, errors.New("server is shutting down"))
+		return
+	}
+	// Shutdown waits on the registry, so unregister only after Close has
+	// finished the Doubao session.
+	defer func() {
+		session.Close()
+		h.sessions.remove(active)
+	}()
+
+	if err := writer.writeJSON(h.readyMessage(session, sessCfg, startMsg.ProtocolVersion)); err != nil {
 		return
 	}
 
-	errCh := make(chan error, 2)
+	ackCh := make(chan struct{})
+	replayCh := make(chan struct{}, 1)
+	errCh := make(chan error, 3)
+	frontendDone := make(chan struct{})
 	go func() {
-		errCh <- h.pipeFrontend(conn, session)
+		defer close(frontendDone)
+		f := &frontend{
+			writer:        writer,
+			session:       session,
+			voices:        h.voices,
+			ackCh:         ackCh,
+			replayCh:      replayCh,
+			emptyFinishes: sessCfg.Session.ASR.EmptyFrameFinishes,
+			integrity:     sessCfg.Session.AudioIntegrity,
+		}
+		errCh <- h.pipeFrontend(conn, f)
+	}()
+	// Runs before the deferred session.Close: closing the connection ends
+	// pipeFrontend's read, and waiting for it means no control frame is
+	// dispatched to a closed session.
+	defer func() {
+		conn.Close()
+		<-frontendDone
 	}()
 	go func() {
-		errCh <- h.pipeBackend(writer, session)
+		errCh <- h.pipeBackend(ctx, sessCfg.Session.TTS, writer, session, replayCh)
 	}()
+	if !asrOnly {
+		go func() {
+			if err := h.greet(ctx, sessCfg.Session.Dialog, session, ackCh); err != nil {
+				_ = writer.writeJSON(errorMessage(err))
+				errCh <- err
+			}
+		}()
+	}
 
 	err = <-errCh
+	if errors.Is(err, errStop) {
+		err = drainStop(ctx, session, errCh, sessCfg.Session.StopTimeoutMS)
+	}
+	canceled := ctx.Err() != nil
 	cancel()
-	if err != nil && !errors.Is(err, context.Canceled) && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+	clientClosed := websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+	if err != nil && !canceled && !errors.Is(err, context.Canceled) && !clientClosed {
 		glog.Warningf("ws session ended with error: %v", err)
 	}
+	if !clientClosed {
+		var rl *volc.RateLimitError
+		if errors.As(session.Err(), &rl) {
+			_ = writer.writeJSON(errorMessage(rl))
+		}
+		code, reason := closeStatus(err, active)
+		closeConn(conn, code, reason)
+	}
 }
 
-func (h *Handler) readStart(conn *websocket.Conn) (clientStartMessage, error) {
+// startSession opens the voice session for a validated start message.
+func (h *Handler) startSession(ctx context.Context, live *liveConfig, start clientStartMessage, asrOnly bool) (*voice.Session, *config.Config, error) {
+	sessCfg, err := h.sessionConfig(live.cfg, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := start.sessionOptions()
+	if asrOnly {
+		opts = append(opts, voice.WithASROnly())
+	}
+	if live.pool != nil {
+		if client := live.pool.Get(ctx, sessCfg); client != nil {
+			opts = append(opts, voice.WithClient(client))
+		}
+	}
+	format := voice.InputFormat{
+		SampleRate: start.SampleRate,
+		Encoding:   voice.Encoding(start.Encoding),
+	}
+	session, err := voice.NewSession(ctx, sessCfg, format, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, sessCfg, nil
+}
+
+func (h *Handler) readyMessage(session *voice.Session, cfg *config.Config, version int) map[string]any {
+	return map[string]any{
+		"type":            "ready",
+		"endpoint":        session.Endpoint(),
+		"sessionId":       session.ID(),
+		"dialogId":        session.DialogID(),
+		"protocolVersion": version,
+		"features":        h.features(cfg, version),
+	}
+}
+
+// sessionConfig returns the config a new session starts with, applying the
+// client's start overrides and resolving a cloned voice name to its speaker ID.
+func (h *Handler) sessionConfig(base *config.Config, start clientStartMessage) (*config.Config, error) {
+	cfg := *base
+	if start.DialogID != "" {
+		cfg.Session.Dialog.DialogID = start.DialogID
+	}
+	if start.EmptyFrameFinishes != nil {
+		cfg.Session.ASR.EmptyFrameFinishes = *start.EmptyFrameFinishes
+	}
+	if start.EndSmoothWindowMS != nil {
+		cfg.Session.ASR.Extra.EndSmoothWindowMS = *start.EndSmoothWindowMS
+	}
+	if start.MaxResponseTokens != nil {
+		cfg.Session.Dialog.MaxResponseTokens = *start.MaxResponseTokens
+	}
+	if start.Model != "" {
+		cfg.Session.Dialog.Extra.Model = start.Model
+	}
+	role, err := config.RenderSystemRole(cfg.Session.Dialog.SystemRole, start.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Session.Dialog.SystemRole = role
+	if greeting, ok := config.RenderPersonalGreeting(cfg.Session.Dialog, start.Metadata); ok {
+		cfg.Session.Dialog.Greeting = greeting
+	}
+	cfg.Session.TTS.OutputFrameMS, cfg.Session.TTS.OutputFrameBytes = start.outputFrame(cfg.Session.TTS)
+	if h.voices != nil {
+		if id, ok := h.voices.Resolve(cfg.Session.TTS.Speaker); ok {
+			cfg.Session.TTS.Speaker = id
+		}
+	}
+	if err := config.CheckSpeakerModel(cfg.Session.TTS.Speaker, cfg.Session.Dialog.Extra.Model); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (h *Handler) readStart(conn *websocket.Conn, cfg *config.Config) (clientStartMessage, error) {
 	if err := conn.SetReadDeadline(time.Now().Add(15 * time.Second)); err != nil {
 		return clientStartMessage{}, err
 	}
-	mt, data, err := conn.ReadMessage()
+	mt, r, err := conn.NextReader()
 	if err != nil {
 		return clientStartMessage{}, err
 	}
+	if mt == websocket.BinaryMessage {
+		return clientStartMessage{}, errAudioBeforeStart
+	}
 	if mt != websocket.TextMessage {
 		return clientStartMessage{}, errors.New("期待 type=start 的文本消息")
 	}
+	data, err := io.ReadAll(io.LimitReader(r, startMessageLimit+1))
+	if err != nil {
+		return clientStartMessage{}, err
+	}
+	if len(data) > startMessageLimit {
+		return clientStartMessage{}, errStartTooLarge
+	}
 	var msg clientStartMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
-		return clientStartMessage{}, err
+		return clientStartMessage{}, &controlError{code: "malformed_message", msg: fmt.Sprintf("start 消息不是合法的 JSON: %v", err)}
 	}
 	if msg.Type != "start" {
 		return clientStartMessage{}, errors.New("首条消息必须是 {type:\"start\"}")
 	}
+	if err := checkStart(&msg, cfg); err != nil {
+		return clientStartMessage{}, err
+	}
+	return msg, nil
+}
+
+// checkStart validates a start message against cfg and fills in defaults.
+func checkStart(msg *clientStartMessage, cfg *config.Config) error {
+	if inputMod := cfg.Session.Dialog.Extra.InputMod; msg.InputMod != "" && msg.InputMod != inputMod {
+		return fmt.Errorf("客户端输入模式 %q 与服务端配置 %q 不一致", msg.InputMod, inputMod)
+	}
+	if msg.OutputMod == "audio" && !cfg.Session.TTS.AudioEnabled() {
+		return errors.New("服务端未启用语音合成 (session.tts.enabled=false)，请使用 outputMod \"text\"")
+	}
+	version, err := negotiateVersion(msg.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+	msg.ProtocolVersion = version
+	if msg.EndSmoothWindowMS != nil {
+		if err := config.CheckEndSmoothWindow(*msg.EndSmoothWindowMS); err != nil {
+			return err
+		}
+	}
+	if msg.MaxResponseTokens != nil {
+		if err := config.CheckMaxResponseTokens(*msg.MaxResponseTokens); err != nil {
+			return err
+		}
+	}
+	if msg.OutputFrameMS != nil || msg.OutputFrameBytes != nil {
+		ms, bytes := msg.outputFrame(cfg.Session.TTS)
+		if err := config.CheckOutputFrame(ms, bytes, cfg.Session.TTS.AudioConfig); err != nil {
+			return err
+		}
+	}
+	if msg.Model != "" {
+		if err := config.CheckModel(msg.Model, cfg.Session.Dialog); err != nil {
+			return &controlError{code: "unsupported_model", msg: err.Error()}
+		}
+	}
+	if _, err := config.RenderSystemRole(cfg.Session.Dialog.SystemRole, msg.Metadata); err != nil {
+		return &controlError{code: "missing_metadata", msg: err.Error()}
+	}
+	if msg.DialogID != "" && !dialogIDPattern.MatchString(msg.DialogID) {
+		return errors.New("dialogId 格式不正确")
+	}
 	if msg.SampleRate == 0 {
 		msg.SampleRate = 48000
 	}
 	if msg.Encoding == "" {
 		msg.Encoding = string(voice.EncodingF32)
 	}
-	return msg, nil
+	if cfg.Session.Dialog.Extra.InputMod != voice.InputModText {
+		if err := voice.CheckEncoding(voice.Encoding(msg.Encoding)); err != nil {
+			return err
+		}
+		if err := voice.CheckSampleRate(msg.SampleRate, msg.LowRate); err != nil {
+			return &controlError{code: "unsupported_sample_rate", msg: err.Error()}
+		}
+	}
+	return nil
 }
 
-func (h *Handler) pipeFrontend(conn *websocket.Conn, session *voice.Session) error {
+// greet waits for the optional client ack and the configured delay, then
+// starts the greeting turn.
+func (h *Handler) greet(ctx context.Context, dialog config.DialogConfig, session *voice.Session, ackCh <-chan struct{}) error {
+	if dialog.GreetingWaitAck {
+		select {
+		case <-ackCh:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if dialog.GreetingDelayMS > 0 {
+		timer := time.NewTimer(time.Duration(dialog.GreetingDelayMS) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return session.Greet()
+}
+
+func (h *Handler) pipeFrontend(conn *websocket.Conn, f *frontend) error {
 	for {
 		// Reset read deadline for each message
 		// Using a longer timeout to keep connection alive during silence
@@ -134,51 +584,141 @@ func (h *Handler) pipeFrontend(conn *websocket.Conn, session *voice.Session) err
 			return err
 		}
 		mt, data, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			return fmt.Errorf("client message exceeds server.max_message_bytes (%d): %w", h.cfg.Server.MaxMessageBytes, err)
+		}
 		if err != nil {
 			return err
 		}
-		switch mt {
-		case websocket.BinaryMessage:
-			if err := session.PushAudio(data); err != nil {
-				return err
-			}
-		case websocket.TextMessage:
-			var msg clientControlMessage
-			if err := json.Unmarshal(data, &msg); err != nil {
-				continue
-			}
-			if msg.Type == "stop" {
-				return nil
-			}
-		default:
-			glog.Infof("ignore message type=%d", mt)
+		if err := f.handleFrame(mt, data); err != nil {
+			return err
 		}
 	}
 }
 
-func (h *Handler) pipeBackend(writer *wsWriter, session *voice.Session) error {
-	// Handle both audio and events
-	for {
+// drainStop is the clean stop sequence, run once the client sent stop and
+// pipeFrontend returned: the client's input was already flushed, the session
+// lets the reply in progress finish and Doubao close the session, and
+// pipeBackend keeps writing until the session's output closes. Canceling
+// right away instead would race pipeBackend's last writes and cut off the
+// final sentence. The wait is bounded by session.stop_timeout_ms; a stop
+// that outlasts it is still a clean stop, so only a backend failure is
+// returned.
+func drainStop(ctx context.Context, session *voice.Session, errCh <-chan error, timeoutMS int) error {
+	session.Stop()
+	timer := time.NewTimer(time.Duration(timeoutMS) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		glog.Infof("session %s: reply still playing %dms after stop, closing", session.ID(), timeoutMS)
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// handleFrame processes one client frame: audio is pushed to the session and
+// control messages are dispatched. Control errors are reported to the client
+// and swallowed; errStop and fatal errors are returned.
+func (f *frontend) handleFrame(mt int, data []byte) error {
+	switch mt {
+	case websocket.BinaryMessage:
+		return f.pushAudio(data)
+	case websocket.TextMessage:
+		err := f.dispatch(data)
+		var ctrlErr *controlError
+		if errors.As(err, &ctrlErr) {
+			return f.writer.writeJSON(errorMessage(err))
+		}
+		return err
+	default:
+		glog.Infof("ignore message type=%d", mt)
+	}
+	return nil
+}
+
+// pushAudio sends client audio to the session unless the client muted it.
+func (f *frontend) pushAudio(data []byte) error {
+	if f.muted {
+		return nil
+	}
+	push := f.session.PushAudio
+	if len(data) == 0 && f.emptyFinishes {
+		push = func([]byte) error { return f.session.FinishInput() }
+	}
+	if err := push(data); err != nil {
+		if errors.Is(err, voice.ErrTextMode) {
+			_ = f.writer.writeJSON(errorMessage(err))
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) pipeBackend(ctx context.Context, tts config.TTSConfig, writer clientWriter, session *voice.Session, replayCh <-chan struct{}) error {
+	var audio voice.AudioSink = writer
+	pace := newPacer(tts)
+	chunks := newRechunker(tts)
+	var linger <-chan time.Time
+	send := func(frame []byte) error {
+		if len(frame) == 0 {
+			return nil
+		}
+		if err := pace.wait(ctx, len(frame)); err != nil {
+			return err
+		}
+		return writeAudio(audio, frame, tts)
+	}
+	// Handle both audio and events until both are closed, so frames
+	// queued behind the last event are still delivered.
+	audioCh, eventCh := session.Audio(), session.Events()
+	for audioCh != nil || eventCh != nil {
 		select {
-		case data, ok := <-session.Audio():
+		case <-replayCh:
+			if err := h.replayLast(ctx, tts, writer, session, pace); err != nil {
+				return err
+			}
+		case data, ok := <-audioCh:
 			if !ok {
-				return session.Err() // Channel closed
+				audioCh = nil
+				if err := send(chunks.flush()); err != nil {
+					return err
+				}
+				continue
 			}
 			if len(data) == 0 {
 				continue
 			}
-			if err := writer.writeBinary(data); err != nil {
+			for _, frame := range chunks.push(data) {
+				if err := send(frame); err != nil {
+					return err
+				}
+			}
+			linger = chunks.lingerTimer()
+		case <-linger:
+			linger = nil
+			if err := send(chunks.flush()); err != nil {
 				return err
 			}
-		case evt, ok := <-session.Events():
+		case evt, ok := <-eventCh:
 			if !ok {
-				return session.Err()
+				eventCh = nil
+				continue
+			}
+			if evt.Type == "audio_flush" {
+				pace.reset()
+				chunks.reset()
+				linger = nil
 			}
 
-			jsonMsg := map[string]any{
+			jsonMsg := h.transform(map[string]any{
 				"type":     evt.Type,
 				"event_id": evt.EventID,
-				"payload":  json.RawMessage(evt.Payload),
+				"payload":  eventPayload(evt.Payload),
+			})
+			if jsonMsg == nil {
+				continue
 			}
 
 			if err := writer.writeJSON(jsonMsg); err != nil {
@@ -186,14 +726,122 @@ func (h *Handler) pipeBackend(writer *wsWriter, session *voice.Session) error {
 			}
 		}
 	}
+	return session.Err()
+}
+
+// eventPayload nests a JSON payload in the event frame as is; wrapping it in
+// json.RawMessage keeps the []byte from being encoded as a base64 string.
+// Payloads that are not JSON would make the whole frame unencodable, so an
+// empty one becomes null and anything else is sent as a string.
+func eventPayload(payload []byte) any {
+	switch {
+	case len(payload) == 0:
+		return nil
+	case json.Valid(payload):
+		return json.RawMessage(payload)
+	default:
+		return string(payload)
+	}
+}
+
+// writeAudio writes a TTS frame and reports a client stall once the write
+// has been blocked for session.tts.stall_threshold_ms: the client stopped
+// draining its socket, so its playback has most likely run dry. The stall is
+// counted and logged by a timer while the write is still in flight, not
+// queued behind it on the same socket. While a write blocks pipeBackend
+// takes no more frames, so session.audio_buffer fills and the session stops
+// reading from Doubao until the client catches up; no separate pause is
+// needed.
+func writeAudio(audio voice.AudioSink, data []byte, tts config.TTSConfig) error {
+	start := time.Now()
+	timer := time.AfterFunc(time.Duration(tts.StallThresholdMS)*time.Millisecond, func() {
+		metrics.ClientStalls.Add(1)
+		glog.V(1).Infof("client audio write blocked for over %dms", tts.StallThresholdMS)
+	})
+	err := audio.Write(data)
+	if !timer.Stop() {
+		glog.V(1).Infof("client audio write unblocked after %s", time.Since(start))
+	}
+	return err
+}
+
+// replayLast re-streams the last bot turn between replay_start and
+// replay_end, in 100 ms frames so pacing and client playback behave as they
+// do for live audio.
+func (h *Handler) replayLast(ctx context.Context, tts config.TTSConfig, writer clientWriter, session *voice.Session, pace *pacer) error {
+	data := session.LastTurn()
+	if len(data) == 0 {
+		return writer.writeJSON(map[string]any{"type": "replay_empty"})
+	}
+	if err := writer.writeJSON(map[string]any{"type": "replay_start"}); err != nil {
+		return err
+	}
+	frame := tts.FrameBytes()
+	if frame == 0 {
+		frame = max(tts.AudioConfig.BytesPerSecond()/10, 1)
+	}
+	for len(data) > 0 {
+		n := min(frame, len(data))
+		if err := pace.wait(ctx, n); err != nil {
+			return err
+		}
+		if err := writeAudio(writer, data[:n], tts); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writer.writeJSON(map[string]any{"type": "replay_end"})
 }
 
 func (h *Handler) writeError(conn *websocket.Conn, err error) {
 	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	_ = conn.WriteJSON(map[string]any{
+	_ = conn.WriteJSON(errorMessage(err))
+}
+
+// errorMessage builds the error frame, tagging errors the client can act on
+// with a machine-readable code.
+func errorMessage(err error) map[string]any {
+	msg := map[string]any{
 		"type":    "error",
 		"message": err.Error(),
-	})
+	}
+	var rl *volc.RateLimitError
+	if errors.As(err, &rl) {
+		msg["type"] = "try_later"
+		msg["retry_after_ms"] = rl.RetryAfter.Milliseconds()
+		return msg
+	}
+	var encErr *voice.UnsupportedEncodingError
+	var ctrlErr *controlError
+	var featErr *volc.FeatureUnavailableError
+	switch {
+	case errors.Is(err, volc.ErrDialogNotFound):
+		msg["code"] = "dialog_not_found"
+	case errors.Is(err, voice.ErrStalled):
+		msg["code"] = "stalled"
+	case errors.As(err, &ctrlErr):
+		msg["code"] = ctrlErr.code
+	case errors.As(err, &featErr):
+		msg["code"] = "feature_unavailable"
+		msg["feature"] = featErr.Feature
+	case errors.Is(err, errAudioBeforeStart):
+		msg["code"] = "audio_before_start"
+	case errors.Is(err, errProtocolVersion):
+		msg["code"] = "unsupported_protocol_version"
+		msg["min_version"] = minProtocolVersion
+		msg["max_version"] = maxProtocolVersion
+	case errors.As(err, &encErr):
+		msg["code"] = "unsupported_encoding"
+		msg["supported"] = encErr.Supported
+	}
+	return msg
+}
+
+// clientWriter sends frames to one frontend session: a whole connection for
+// /ws/realtime, or one sub-session of a /ws/mux connection.
+type clientWriter interface {
+	voice.AudioSink
+	writeJSON(v any) error
 }
 
 type wsWriter struct {
@@ -210,11 +858,25 @@ func (w *wsWriter) writeJSON(v any) error {
 	return w.conn.WriteJSON(v)
 }
 
+// Write sends a TTS frame to the client, making wsWriter a voice.AudioSink.
+func (w *wsWriter) Write(pcm []byte) error {
+	return w.writeBinary(pcm)
+}
+
+// Close is a no-op: the connection is owned by handleRealtime.
+func (w *wsWriter) Close() error {
+	return nil
+}
+
 func (w *wsWriter) writeBinary(data []byte) error {
+	return w.writeMessage(websocket.BinaryMessage, data)
+}
+
+func (w *wsWriter) writeMessage(mt int, data []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
 		return err
 	}
-	return w.conn.WriteMessage(websocket.BinaryMessage, data)
+	return w.conn.WriteMessage(mt, data)
 }
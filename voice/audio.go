@@ -4,6 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+
+	"meow-ai/metrics"
 )
 
 const (
@@ -16,50 +21,299 @@ type Encoding string
 const (
 	EncodingF32 Encoding = "f32le"
 	EncodingS16 Encoding = "s16le"
+	// EncodingS24 is packed 24-bit PCM, three bytes per sample, as
+	// delivered by some pro audio interfaces.
+	EncodingS24 Encoding = "s24le"
 )
 
+// SupportedEncodings lists the input encodings decodeSamples understands.
+var SupportedEncodings = []Encoding{EncodingF32, EncodingS16, EncodingS24}
+
+// UnsupportedEncodingError reports an encoding with no decoder together with
+// the ones the client can renegotiate to.
+type UnsupportedEncodingError struct {
+	Encoding  Encoding
+	Supported []Encoding
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported encoding %q, supported: %v", e.Encoding, e.Supported)
+}
+
+// CheckEncoding returns an *UnsupportedEncodingError unless enc has a decoder.
+func CheckEncoding(enc Encoding) error {
+	for _, supported := range SupportedEncodings {
+		if enc == supported {
+			return nil
+		}
+	}
+	return &UnsupportedEncodingError{Encoding: enc, Supported: SupportedEncodings}
+}
+
+// Low-rate inputs accepted below the 16 kHz ASR rate. They are upsampled
+// linearly, which cannot restore what was never captured:
+//
+//   - 8000 (narrowband, telephone quality) halves uplink bandwidth versus
+//     16 kHz s16. Everything above 4 kHz is lost, so fricatives (s, f, sh)
+//     blur and recognition accuracy drops, most for short words and digits.
+//   - 11025 and 12000 keep up to 5.5/6 kHz and sit between the two.
+//
+// Any rate from 16000 up to maxInputSampleRate is accepted as well.
+var LowSampleRates = []int{8000, 11025, 12000}
+
+const maxInputSampleRate = 192000
+
+// CheckSampleRate validates an input rate. Low rates are accepted only from
+// LowSampleRates; unless the client declared lowRate, using one is logged
+// since it is more often a misconfigured capture than a deliberate choice.
+func CheckSampleRate(rate int, lowRate bool) error {
+	if rate >= targetSampleRate && rate <= maxInputSampleRate {
+		return nil
+	}
+	for _, low := range LowSampleRates {
+		if rate == low {
+			if !lowRate {
+				glog.Warningf("client sends %d Hz audio without the lowRate hint, recognition quality will suffer", rate)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported sample rate %d, use %v or %d-%d", rate, LowSampleRates, targetSampleRate, maxInputSampleRate)
+}
+
 type InputFormat struct {
 	SampleRate int
 	Encoding   Encoding
+	// Channels is the number of interleaved channels, downmixed to mono.
+	// Zero means mono.
+	Channels int
 }
 
 type PCMProcessor struct {
 	format    InputFormat
 	resampler *linearResampler
+	started   bool
+	// partial is the trailing partial interleaved frame of the last
+	// multi-channel input, carried into the next one.
+	partial []byte
+
+	// Sample counters and the resampler position, readable concurrently
+	// through Counters.
+	inSamples  atomic.Uint64
+	outSamples atomic.Uint64
+	posBits    atomic.Uint64
+}
+
+// ResamplerCounters is a snapshot of the samples that went into and came out
+// of the resampler. Over a long session Out/In should track the rate ratio;
+// a drift means audio is being lost or duplicated.
+type ResamplerCounters struct {
+	InSamples  uint64  `json:"in_samples"`
+	OutSamples uint64  `json:"out_samples"`
+	Position   float64 `json:"position"`
+}
+
+// Counters returns the current sample counters.
+func (p *PCMProcessor) Counters() ResamplerCounters {
+	return ResamplerCounters{
+		InSamples:  p.inSamples.Load(),
+		OutSamples: p.outSamples.Load(),
+		Position:   math.Float64frombits(p.posBits.Load()),
+	}
+}
+
+func (p *PCMProcessor) countOut(n int) {
+	p.outSamples.Add(uint64(n))
+	metrics.ResamplerOutputSamples.Add(int64(n))
+	if p.resampler != nil {
+		p.posBits.Store(math.Float64bits(p.resampler.pos))
+	}
 }
 
 func NewPCMProcessor(format InputFormat) (*PCMProcessor, error) {
+	p := &PCMProcessor{}
+	if err := p.setFormat(format); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PCMProcessor) setFormat(format InputFormat) error {
 	if format.SampleRate <= 0 {
-		return nil, fmt.Errorf("invalid sample rate")
+		return fmt.Errorf("invalid sample rate")
 	}
 	if format.Encoding == "" {
 		format.Encoding = EncodingF32
 	}
+	if err := CheckEncoding(format.Encoding); err != nil {
+		return err
+	}
+	if format.Channels <= 0 {
+		format.Channels = targetChannels
+	}
 	var res *linearResampler
 	if format.SampleRate != targetSampleRate {
 		res = newLinearResampler(format.SampleRate, targetSampleRate)
 	}
-	return &PCMProcessor{
-		format:    format,
-		resampler: res,
-	}, nil
+	p.format = format
+	p.resampler = res
+	return nil
+}
+
+// Format returns the effective input format, which a WAV header in the first
+// frame may have overridden.
+func (p *PCMProcessor) Format() InputFormat {
+	return p.format
 }
 
 func (p *PCMProcessor) Process(frame []byte) ([]byte, error) {
+	frame, err := p.prepare(frame)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := p.decode(frame)
+	if err != nil {
+		return nil, err
+	}
+	return p.resample(samples), nil
+}
+
+// prepare handles stream-level framing: a WAV header in the first frame
+// switches the format and is stripped, and multi-channel input is cut to
+// whole interleaved frames. It must run in frame order.
+func (p *PCMProcessor) prepare(frame []byte) ([]byte, error) {
+	if !p.started {
+		p.started = true
+		if IsWAV(frame) {
+			var err error
+			if frame, err = p.applyWAVHeader(frame); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p.carryPartial(frame), nil
+}
+
+// carryPartial holds back a trailing partial interleaved frame and prepends
+// it to the next input, so a frame split across messages keeps its samples
+// and the channels stay aligned, as the resampler carries its last sample.
+func (p *PCMProcessor) carryPartial(frame []byte) []byte {
+	if p.format.Channels <= targetChannels {
+		return frame
+	}
+	if len(p.partial) > 0 {
+		frame = append(p.partial, frame...)
+		p.partial = nil
+	}
+	size := sampleBytes(p.format.Encoding) * p.format.Channels
+	whole := len(frame) - len(frame)%size
+	if whole < len(frame) {
+		p.partial = append([]byte(nil), frame[whole:]...)
+	}
+	return frame[:whole]
+}
+
+// decode converts a frame to mono float samples. It only reads the format
+// and is safe to run concurrently once prepare has seen the first frame.
+func (p *PCMProcessor) decode(frame []byte) ([]float32, error) {
 	samples, err := decodeSamples(frame, p.format.Encoding)
 	if err != nil {
 		return nil, err
 	}
+	if p.format.Channels > targetChannels {
+		samples = downmix(samples, p.format.Channels)
+	}
+	return samples, nil
+}
+
+// resample converts decoded samples to 16 kHz s16. The resampler carries
+// state across frames, so calls must be made in frame order.
+func (p *PCMProcessor) resample(samples []float32) []byte {
 	if len(samples) == 0 {
-		return nil, nil
+		return nil
 	}
+	p.inSamples.Add(uint64(len(samples)))
+	metrics.ResamplerInputSamples.Add(int64(len(samples)))
 	if p.resampler != nil {
 		samples = p.resampler.Process(samples)
 	}
+	p.countOut(len(samples))
 	if len(samples) == 0 {
-		return nil, nil
+		return nil
+	}
+	return float32ToS16Bytes(samples)
+}
+
+// Flush returns the samples still held back by the resampler, encoded like
+// Process output, and resets the stream state so the next frame starts fresh.
+// A partial interleaved frame still carried is dropped.
+func (p *PCMProcessor) Flush() []byte {
+	p.partial = nil
+	if p.resampler == nil {
+		return nil
+	}
+	samples := p.resampler.Flush()
+	p.countOut(len(samples))
+	if len(samples) == 0 {
+		return nil
+	}
+	return float32ToS16Bytes(samples)
+}
+
+// applyWAVHeader switches the processor to the format declared by a WAV
+// header at the start of the stream and returns the sample bytes that follow
+// it. The header must be fully contained in the first frame.
+func (p *PCMProcessor) applyWAVHeader(frame []byte) ([]byte, error) {
+	h, err := ParseWAVHeader(frame)
+	if err != nil {
+		return nil, fmt.Errorf("parse wav header: %w", err)
+	}
+	var enc Encoding
+	switch {
+	case h.AudioFormat == wavFormatPCM && h.BitsPerSample == 16:
+		enc = EncodingS16
+	case h.AudioFormat == wavFormatPCM && h.BitsPerSample == 24:
+		enc = EncodingS24
+	case h.AudioFormat == wavFormatFloat && h.BitsPerSample == 32:
+		enc = EncodingF32
+	default:
+		return nil, fmt.Errorf("unsupported wav format=%d bits=%d", h.AudioFormat, h.BitsPerSample)
+	}
+	// The header overrides the start message's checked sampleRate, so it
+	// gets the same check; an absurd rate would make the resampler's output
+	// explode or vanish.
+	if err := CheckSampleRate(h.SampleRate, true); err != nil {
+		return nil, fmt.Errorf("wav header: %w", err)
+	}
+	if err := p.setFormat(InputFormat{SampleRate: h.SampleRate, Encoding: enc, Channels: h.Channels}); err != nil {
+		return nil, err
 	}
-	return float32ToS16Bytes(samples), nil
+	return frame[h.DataOffset:], nil
+}
+
+// downmix averages interleaved channels into a mono signal, dropping any
+// trailing partial frame; client input reaches it whole via carryPartial.
+func downmix(samples []float32, channels int) []float32 {
+	out := make([]float32, len(samples)/channels)
+	for i := range out {
+		var sum float32
+		for c := 0; c < channels; c++ {
+			sum += samples[i*channels+c]
+		}
+		out[i] = sum / float32(channels)
+	}
+	return out
+}
+
+// sampleBytes is the size of one sample of a supported encoding.
+func sampleBytes(encoding Encoding) int {
+	switch encoding {
+	case EncodingS16:
+		return 2
+	case EncodingS24:
+		return 3
+	}
+	return 4
 }
 
 func decodeSamples(data []byte, encoding Encoding) ([]float32, error) {
@@ -86,6 +340,20 @@ func decodeSamples(data []byte, encoding Encoding) ([]float32, error) {
 			samples[i] = float32(v) / 32768.0
 		}
 		return samples, nil
+	case EncodingS24:
+		if len(data)%3 != 0 {
+			return nil, fmt.Errorf("unaligned s24 frame")
+		}
+		count := len(data) / 3
+		samples := make([]float32, count)
+		for i := 0; i < count; i++ {
+			b := data[i*3 : (i+1)*3]
+			// Shift the sample into the top of an int32 so the arithmetic
+			// shift back sign-extends it.
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			samples[i] = float32(v) / 8388608.0
+		}
+		return samples, nil
 	default:
 		return nil, fmt.Errorf("unsupported encoding %s", encoding)
 	}
@@ -100,13 +368,20 @@ func float32ToS16Bytes(samples []float32) []byte {
 	return buf
 }
 
+// float32ToS16 scales by 32768 so that -1.0 maps to -32768 and the s16
+// decode in decodeSamples round-trips exactly; +1.0 and above clamp to 32767.
 func float32ToS16(v float32) int16 {
-	if v > 1 {
-		v = 1
-	} else if v < -1 {
-		v = -1
+	scaled := math.Round(float64(v) * 32768)
+	if math.IsNaN(scaled) {
+		return 0
+	}
+	if scaled > math.MaxInt16 {
+		return math.MaxInt16
 	}
-	return int16(math.Round(float64(v) * 32767))
+	if scaled < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(scaled)
 }
 
 type linearResampler struct {
@@ -118,6 +393,8 @@ type linearResampler struct {
 	lastSample float32
 	hasLast    bool
 	work       []float32
+	// out is reused across calls, see Process.
+	out []float32
 }
 
 func newLinearResampler(src, dst int) *linearResampler {
@@ -128,6 +405,14 @@ func newLinearResampler(src, dst int) *linearResampler {
 	}
 }
 
+// Process resamples the next chunk of the stream. The returned slice is
+// reused by the next call, so callers must consume it first.
+//
+// Only the newest input sample is held back, as the left neighbour of the
+// next interpolation; everything before it is output at once. A run of tiny
+// frames therefore never accumulates: a frame that yields nothing (a lone
+// first sample, or a downsampled frame shorter than one output step) delays
+// at most that one sample until the next frame, and FinishInput flushes it.
 func (r *linearResampler) Process(samples []float32) []float32 {
 	if len(samples) == 0 {
 		return nil
@@ -144,32 +429,48 @@ func (r *linearResampler) Process(samples []float32) []float32 {
 		data = r.work
 	}
 	lastIdx := len(data) - 1
+	// A lone sample with nothing carried cannot be interpolated yet. It is
+	// carried as data[0] of the next frame and pos is left untouched, so a
+	// stream of 1-sample frames yields exactly the full-buffer output.
 	if lastIdx <= 0 {
 		r.lastSample = data[lastIdx]
 		r.hasLast = true
 		return nil
 	}
 	outCap := int(float64(len(samples))*float64(r.dstRate)/float64(r.srcRate)) + 4
-	out := make([]float32, 0, outCap)
-	pos := r.pos
-	for {
+	if cap(r.out) < outCap {
+		r.out = make([]float32, 0, outCap)
+	}
+	out := r.out[:0]
+	// pos is never negative, so int(pos)+1 <= lastIdx is pos < lastIdx.
+	// pos keeps accumulating step rather than being recomputed from an
+	// index, which keeps the output bit-identical to earlier releases.
+	pos, step, limit := r.pos, r.step, float64(lastIdx)
+	for pos < limit {
 		idx := int(pos)
-		next := idx + 1
-		if next > lastIdx {
-			break
-		}
-		frac := pos - float64(idx)
-		a := data[idx]
-		b := data[next]
-		value := a*(1-float32(frac)) + b*float32(frac)
-		out = append(out, value)
-		pos += r.step
+		frac := float32(pos - float64(idx))
+		a, b := data[idx], data[idx+1]
+		out = append(out, a*(1-frac)+b*frac)
+		pos += step
 	}
+	r.out = out
+	// The loop exits with pos >= lastIdx, so the carried position is never
+	// negative and the next frame resumes exactly at the carried sample.
 	r.pos = pos - float64(lastIdx)
-	if r.pos < 0 {
-		r.pos = 0
-	}
 	r.lastSample = data[lastIdx]
 	r.hasLast = true
 	return out
 }
+
+// Flush emits the carried sample that would otherwise wait for the next
+// frame, holding it as the right-hand neighbour of the final interpolation,
+// and resets the resampler.
+func (r *linearResampler) Flush() []float32 {
+	if !r.hasLast {
+		return nil
+	}
+	out := []float32{r.lastSample}
+	r.hasLast = false
+	r.pos = 0
+	return out
+}
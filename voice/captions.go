@@ -0,0 +1,102 @@
+package voice
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Caption is one committed user utterance, timed by the audio the session
+// had sent upstream when ASR first reported it and when it became final.
+type Caption struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// captionPayload is the JSON form of a caption event, in milliseconds.
+type captionPayload struct {
+	StartMS int64  `json:"start_ms"`
+	EndMS   int64  `json:"end_ms"`
+	Text    string `json:"text"`
+}
+
+// audioPosition is how much user audio has gone upstream, which is the
+// timeline ASR results refer to.
+func (s *Session) audioPosition() time.Duration {
+	return time.Duration(s.sentBytes.Load()) * time.Second / (targetSampleRate * 2)
+}
+
+// trackCaption follows interim results to the final one. The first interim
+// of an utterance fixes its start and the final result its end, so the
+// caption covers the speech rather than just the moment it was committed.
+func (s *Session) trackCaption(text string, final bool) {
+	if !s.cfg.Session.Captions {
+		return
+	}
+	pos := s.audioPosition()
+	if !s.captionOpen {
+		s.captionOpen = true
+		s.captionStart = pos
+		if final {
+			// No interim preceded it; assume about a second of speech.
+			s.captionStart = max(s.captionEnd, pos-time.Second)
+		}
+	}
+	if !final {
+		return
+	}
+	c := Caption{Start: s.captionStart, End: max(pos, s.captionStart+time.Second), Text: text}
+	s.captionOpen = false
+	s.captionEnd = c.End
+	s.captionMu.Lock()
+	s.captions = append(s.captions, c)
+	s.captionMu.Unlock()
+	s.emitJSON("caption", eventASRResponse, captionPayload{StartMS: c.Start.Milliseconds(), EndMS: c.End.Milliseconds(), Text: c.Text})
+}
+
+// Captions returns the captions committed so far.
+func (s *Session) Captions() []Caption {
+	s.captionMu.Lock()
+	defer s.captionMu.Unlock()
+	return append([]Caption(nil), s.captions...)
+}
+
+// CaptionFromPayload decodes a recorded caption event.
+func CaptionFromPayload(data []byte) (Caption, error) {
+	var p captionPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Caption{}, err
+	}
+	return Caption{
+		Start: time.Duration(p.StartMS) * time.Millisecond,
+		End:   time.Duration(p.EndMS) * time.Millisecond,
+		Text:  p.Text,
+	}, nil
+}
+
+// FormatVTT renders captions as a WebVTT document.
+func FormatVTT(captions []Caption) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, c := range captions {
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n%s\n", i+1, captionTime(c.Start, "."), captionTime(c.End, "."), c.Text)
+	}
+	return b.String()
+}
+
+// FormatSRT renders captions as SubRip.
+func FormatSRT(captions []Caption) string {
+	var b strings.Builder
+	for i, c := range captions {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, captionTime(c.Start, ","), captionTime(c.End, ","), c.Text)
+	}
+	return b.String()
+}
+
+// captionTime formats d as HH:MM:SS followed by sep and milliseconds.
+func captionTime(d time.Duration, sep string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
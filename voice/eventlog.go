@@ -0,0 +1,78 @@
+package voice
+
+import (
+	"sync"
+	"time"
+)
+
+// eventLogPayloadBytes bounds the payload kept per logged event.
+const eventLogPayloadBytes = 512
+
+// LoggedEvent is an event the session forwarded to its client, as kept in
+// the session's event log. Payload is the raw payload as text, cut to
+// eventLogPayloadBytes, so it is not always valid JSON.
+type LoggedEvent struct {
+	Type      string    `json:"type"`
+	EventID   int32     `json:"event_id,omitempty"`
+	Time      time.Time `json:"time"`
+	Payload   string    `json:"payload,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// eventLog is a ring of the last forwarded events, for live debugging
+// through GET /sessions/{id}/events.
+type eventLog struct {
+	mu      sync.Mutex
+	entries []LoggedEvent
+	next    int
+	full    bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{entries: make([]LoggedEvent, size)}
+}
+
+func (l *eventLog) add(evt EventMsg, at time.Time) {
+	entry := LoggedEvent{Type: evt.Type, EventID: evt.EventID, Time: at}
+	payload := evt.Payload
+	if len(payload) > eventLogPayloadBytes {
+		payload, entry.Truncated = payload[:eventLogPayloadBytes], true
+	}
+	entry.Payload = string(payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// last returns up to n entries, oldest first; n <= 0 returns all of them.
+func (l *eventLog) last(n int) []LoggedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	out := make([]LoggedEvent, 0, n)
+	for i := l.next - n; i < l.next; i++ {
+		out = append(out, l.entries[(i+len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+// RecentEvents returns up to the last n events forwarded to the client,
+// oldest first, or all that are kept when n <= 0. It is nil when
+// session.event_log_size is 0.
+func (s *Session) RecentEvents(n int) []LoggedEvent {
+	if s.eventLog == nil {
+		return nil
+	}
+	return s.eventLog.last(n)
+}
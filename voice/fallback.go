@@ -0,0 +1,164 @@
+package voice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/config"
+	"meow-ai/metrics"
+)
+
+// FallbackTTS speaks a reply Doubao delivered as text only. Synthesize
+// returns audio in the session's TTS output format (session.tts.audio_config).
+type FallbackTTS interface {
+	Synthesize(ctx context.Context, text string) ([]byte, error)
+}
+
+// WithFallbackTTS replaces the fallback configured by session.tts.fallback,
+// for embedders with their own secondary TTS.
+func WithFallbackTTS(f FallbackTTS) Option {
+	return func(s *Session) {
+		s.fallback = f
+	}
+}
+
+// newFallbackTTS builds the fallback selected by cfg.Fallback.Mode, nil when
+// it is off.
+func newFallbackTTS(cfg config.TTSConfig) FallbackTTS {
+	switch cfg.Fallback.Mode {
+	case config.FallbackModeBeep:
+		return beepFallback{audio: cfg.AudioConfig}
+	case config.FallbackModeHTTP:
+		return &httpFallback{
+			url:    cfg.Fallback.URL,
+			audio:  cfg.AudioConfig,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return nil
+}
+
+// beepFallback plays two short tones, a notice that the bot answered even
+// though its voice is missing. The reply text still reaches the client.
+type beepFallback struct {
+	audio config.AudioConfig
+}
+
+func (b beepFallback) Synthesize(context.Context, string) ([]byte, error) {
+	rate := b.audio.SampleRate
+	var out []byte
+	for _, freq := range []float64{880, 660} {
+		for _, frame := range ToneFrames(rate, b.audio.Format, freq, rate*3/20, rate) {
+			out = append(out, frame...)
+		}
+	}
+	return out, nil
+}
+
+// httpFallback posts the reply text to a secondary TTS service, which
+// answers with raw audio in the requested format.
+type httpFallback struct {
+	url    string
+	audio  config.AudioConfig
+	client *http.Client
+}
+
+type fallbackRequest struct {
+	Text       string `json:"text"`
+	Format     string `json:"format"`
+	SampleRate int    `json:"sample_rate"`
+	Channel    int    `json:"channel"`
+}
+
+func (f *httpFallback) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	body, err := json.Marshal(fallbackRequest{
+		Text:       text,
+		Format:     f.audio.Format,
+		SampleRate: f.audio.SampleRate,
+		Channel:    f.audio.Channel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal fallback request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("new fallback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call fallback tts: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read fallback response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fallback tts failed status=%d body=%.200s", resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// watchFallback runs after a reply's text ended: if no TTS audio for the
+// turn shows up within the fallback timeout, the text is synthesized by the
+// fallback and queued as the turn's audio. Barge-in cancels the watch, so
+// an interrupted reply is not spoken over the user. It is tracked by
+// fallbackWG so consume does not close audioCh under it.
+//
+// Fallback audio is not written to the sinks, which consume owns, so it is
+// missing from recordings and replay_last.
+func (s *Session) watchFallback(text string, gen int64) {
+	defer s.fallbackWG.Done()
+	select {
+	case <-s.clock.After(time.Duration(s.cfg.Session.TTS.Fallback.TimeoutMS) * time.Millisecond):
+	case <-s.ctx.Done():
+		return
+	}
+	if s.turnAudio.Load() || s.fallbackGen.Load() != gen {
+		return
+	}
+	glog.Warningf("session %s: reply had no audio, using %s fallback", s.ID(), s.cfg.Session.TTS.Fallback.Mode)
+	metrics.TTSFallbacks.Add(1)
+	audio, err := s.fallback.Synthesize(s.ctx, text)
+	if err != nil {
+		glog.Warningf("fallback tts: %v", err)
+		return
+	}
+	if s.fallbackGen.Load() != gen {
+		return // the user barged in while it was synthesized
+	}
+	s.emitJSON("tts_fallback", 0, map[string]any{"mode": s.cfg.Session.TTS.Fallback.Mode})
+	frame := max(s.cfg.Session.TTS.AudioConfig.BytesPerSecond()/10, 1)
+	for len(audio) > 0 {
+		n := min(frame, len(audio))
+		chunk := audio[:n]
+		audio = audio[n:]
+		if s.fallbackGen.Load() != gen {
+			return
+		}
+		if !audioMemory.reserve(n) {
+			s.stats.memoryDrops.Add(1)
+			metrics.AudioMemoryDrops.Add(1)
+			continue
+		}
+		select {
+		case s.audioCh <- chunk:
+		case <-s.ctx.Done():
+			audioMemory.release(n)
+			return
+		}
+	}
+}
+
+// cancelFallback stops the fallback watches of replies the user barged in on.
+func (s *Session) cancelFallback() {
+	s.fallbackGen.Add(1)
+}
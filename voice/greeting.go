@@ -0,0 +1,61 @@
+package voice
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"meow-ai/config"
+)
+
+// errGreetingTimeout is reported in greeting_failed when SayHello did not
+// go through within session.dialog.greeting_timeout_ms.
+var errGreetingTimeout = errors.New("greeting timed out")
+
+const defaultGreeting = "你好，我是%s，有什么可以帮助你的吗？"
+
+// localeGreetings maps a language subtag to its default greeting.
+var localeGreetings = map[string]string{
+	"zh": defaultGreeting,
+	"en": "Hi, I'm %s. How can I help?",
+	"ja": "こんにちは、%sです。何かお手伝いできることはありますか？",
+}
+
+// greetingText renders the greeting for a dialog config: the explicit
+// greeting if set, otherwise the default for the configured language, falling
+// back to Chinese for zh-* and unknown locales.
+func greetingText(dialog config.DialogConfig) string {
+	tmpl := dialog.Greeting
+	if tmpl == "" {
+		lang, _, _ := strings.Cut(strings.ToLower(dialog.Language), "-")
+		var ok bool
+		if tmpl, ok = localeGreetings[lang]; !ok {
+			tmpl = defaultGreeting
+		}
+	}
+	if !strings.Contains(tmpl, "%s") {
+		return tmpl
+	}
+	return fmt.Sprintf(tmpl, dialog.BotName)
+}
+
+// sayHello sends the greeting, giving up after greeting_timeout_ms. The
+// write itself ignores contexts, so it runs in the background; an abandoned
+// write still ends at the client's write deadline.
+func (s *Session) sayHello(text string) error {
+	timeout := time.Duration(s.cfg.Session.Dialog.GreetingTimeoutMS) * time.Millisecond
+	done := make(chan error, 1)
+	s.expectReply()
+	go func() {
+		done <- s.client.SayHello(s.ctx, text)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-s.clock.After(timeout):
+		return errGreetingTimeout
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package voice
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Local speech detection while the greeting plays. Doubao does not report
+// barge-in during SayHello reliably, so user audio louder than
+// greetingBargeInRMS for greetingBargeInFrames consecutive frames cuts the
+// greeting like any other interrupted turn.
+const (
+	greetingBargeInRMS    = 0.05 // about -26 dBFS
+	greetingBargeInFrames = 3
+)
+
+// startGreeting marks the greeting as the turn in progress so barge-in can
+// interrupt it before Doubao reports the first TTS sentence.
+func (s *Session) startGreeting() {
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	s.lastTurn.reset()
+	s.speaking = true
+	s.greeting.Store(true)
+}
+
+// checkGreetingBargeIn runs on user audio sent upstream during the greeting
+// and interrupts it once the user is clearly speaking. It is only called
+// from the audio send path.
+func (s *Session) checkGreetingBargeIn(pcm []byte) {
+	if !s.greeting.Load() {
+		return
+	}
+	if pcmRMS(pcm) < greetingBargeInRMS {
+		s.loudFrames = 0
+		return
+	}
+	s.loudFrames++
+	if s.loudFrames >= greetingBargeInFrames {
+		s.interruptGreeting()
+	}
+}
+
+// interruptGreeting cuts the greeting if it is still playing.
+func (s *Session) interruptGreeting() {
+	if s.greeting.CompareAndSwap(true, false) {
+		s.interrupt("")
+	}
+}
+
+// pcmRMS returns the RMS level of 16-bit PCM as a fraction of full scale.
+func pcmRMS(pcm []byte) float64 {
+	n := len(pcm) / 2
+	if n == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		v := float64(int16(binary.LittleEndian.Uint16(pcm[i*2:]))) / 32768
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(n))
+}
@@ -0,0 +1,95 @@
+package voice
+
+import (
+	"hash/crc32"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"meow-ai/metrics"
+)
+
+// integrityCheck tracks the seq and crc clients attach to audio messages
+// when session.audio_integrity is on. Gaps and mismatches seen here happened
+// before the server got the audio, which separates client capture or
+// network loss from drops in our own processing.
+type integrityCheck struct {
+	mu      sync.Mutex
+	lastSeq int64
+	seqSeen bool
+	turn    IntegrityPayload
+}
+
+// IntegrityPayload summarizes one user turn's audio messages.
+type IntegrityPayload struct {
+	Frames int `json:"frames"`
+	// Missing counts seq numbers skipped over, OutOfOrder frames whose seq
+	// was not above the previous one (replays and reordering).
+	Missing    int64 `json:"missing"`
+	OutOfOrder int   `json:"out_of_order"`
+	// CRCMismatches counts frames whose audio did not match their crc.
+	CRCMismatches int `json:"crc_mismatches"`
+	// Unchecked counts frames sent without a seq or crc.
+	Unchecked int `json:"unchecked"`
+}
+
+// CheckAudioFrame validates the optional seq and crc (CRC-32 IEEE of the
+// decoded audio) of an audio message. It is a no-op unless
+// session.audio_integrity is on; the findings are summarized in an
+// "integrity" event at the end of each user turn.
+func (s *Session) CheckAudioFrame(seq *int64, crc *uint32, audio []byte) {
+	c := s.integrity
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.turn.Frames++
+	if seq == nil || crc == nil {
+		c.turn.Unchecked++
+	}
+	if seq != nil {
+		switch {
+		case !c.seqSeen:
+		case *seq > c.lastSeq+1:
+			missing := *seq - c.lastSeq - 1
+			c.turn.Missing += missing
+			metrics.AudioSeqGaps.Add(missing)
+			glog.Warningf("session %s: audio seq jumped from %d to %d", s.ID(), c.lastSeq, *seq)
+		case *seq <= c.lastSeq:
+			c.turn.OutOfOrder++
+			glog.Warningf("session %s: audio seq %d after %d", s.ID(), *seq, c.lastSeq)
+		}
+		if !c.seqSeen || *seq > c.lastSeq {
+			c.lastSeq, c.seqSeen = *seq, true
+		}
+	}
+	if crc != nil && crc32.ChecksumIEEE(audio) != *crc {
+		c.turn.CRCMismatches++
+		metrics.AudioCRCMismatches.Add(1)
+		glog.Warningf("session %s: audio crc mismatch on seq %v", s.ID(), seqString(seq))
+	}
+}
+
+func seqString(seq *int64) any {
+	if seq == nil {
+		return "none"
+	}
+	return *seq
+}
+
+// reportIntegrity emits the finished turn's integrity summary and starts a
+// new one. Turns without audio messages are not reported.
+func (s *Session) reportIntegrity() {
+	c := s.integrity
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	turn := c.turn
+	c.turn = IntegrityPayload{}
+	c.mu.Unlock()
+	if turn.Frames > 0 {
+		s.emitJSON("integrity", 0, turn)
+	}
+}
@@ -0,0 +1,59 @@
+package voice
+
+import (
+	"sync"
+
+	"meow-ai/metrics"
+)
+
+// audioMemory accounts the TTS audio held in memory across all sessions:
+// frames queued for the frontend and the replay buffers. When the limit
+// would be exceeded new frames are dropped by the session receiving them.
+var audioMemory memoryAccount
+
+// memoryNearFraction of the limit is where new sessions are refused.
+const memoryNearFraction = 0.9
+
+type memoryAccount struct {
+	mu    sync.Mutex
+	used  int64
+	limit int64 // zero means unlimited
+}
+
+// SetAudioMemoryLimit sets server.max_audio_memory_bytes; zero disables the
+// cap while still tracking usage.
+func SetAudioMemoryLimit(limit int64) {
+	audioMemory.mu.Lock()
+	defer audioMemory.mu.Unlock()
+	audioMemory.limit = limit
+}
+
+// AudioMemoryNearLimit reports whether usage is close enough to the cap that
+// new sessions should be refused.
+func AudioMemoryNearLimit() bool {
+	audioMemory.mu.Lock()
+	defer audioMemory.mu.Unlock()
+	return audioMemory.limit > 0 && float64(audioMemory.used) >= memoryNearFraction*float64(audioMemory.limit)
+}
+
+// reserve accounts n bytes, failing if that would exceed the limit.
+func (m *memoryAccount) reserve(n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limit > 0 && m.used+int64(n) > m.limit {
+		return false
+	}
+	m.used += int64(n)
+	metrics.AudioMemoryBytes.Set(m.used)
+	return true
+}
+
+func (m *memoryAccount) release(n int) {
+	if n == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= int64(n)
+	metrics.AudioMemoryBytes.Set(m.used)
+}
@@ -0,0 +1,104 @@
+package voice
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Channels of the stereo mix.
+const (
+	mixUser = 0
+	mixBot  = 1
+)
+
+// stereoMixer time-aligns user and bot audio into a 16 kHz s16 stereo WAV,
+// user on the left and bot on the right. Each chunk is placed at the later
+// of its track's cursor and the wall-clock time it arrived, so a pause
+// becomes silence while a TTS burst, which arrives faster than real time,
+// is laid out back to back as the client plays it. Nothing is ever placed
+// before the arrival time of the latest chunk, so everything earlier is final
+// and written out.
+type stereoMixer struct {
+	out     *wavWriter
+	start   time.Time
+	cursor  [2]int  // next free sample position per track
+	flushed int     // samples already written to out
+	pending []int16 // interleaved frames from flushed onwards
+
+	botFormat    InputFormat
+	botResampler *linearResampler
+}
+
+func newStereoMixer(out *wavWriter, start time.Time, botRate, botChannels int, botEncoding Encoding) *stereoMixer {
+	m := &stereoMixer{
+		out:       out,
+		start:     start,
+		botFormat: InputFormat{SampleRate: botRate, Encoding: botEncoding, Channels: botChannels},
+	}
+	if botRate != targetSampleRate {
+		m.botResampler = newLinearResampler(botRate, targetSampleRate)
+	}
+	return m
+}
+
+// writeUser mixes 16 kHz s16 mono user audio received at now.
+func (m *stereoMixer) writeUser(now time.Time, pcm []byte) error {
+	samples := make([]float32, len(pcm)/2)
+	for i := range samples {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(pcm[i*2:]))) / 32768
+	}
+	return m.place(now, mixUser, samples)
+}
+
+// writeBot mixes TTS audio received at now, converting it to 16 kHz mono.
+func (m *stereoMixer) writeBot(now time.Time, data []byte) error {
+	samples, err := decodeSamples(data, m.botFormat.Encoding)
+	if err != nil {
+		return err
+	}
+	if m.botFormat.Channels > targetChannels {
+		samples = downmix(samples, m.botFormat.Channels)
+	}
+	if m.botResampler != nil {
+		samples = m.botResampler.Process(samples)
+	}
+	return m.place(now, mixBot, samples)
+}
+
+func (m *stereoMixer) place(now time.Time, track int, samples []float32) error {
+	arrival := int(now.Sub(m.start) * targetSampleRate / time.Second)
+	pos := max(m.cursor[track], arrival, m.flushed)
+	end := pos + len(samples)
+	if need := (end - m.flushed) * 2; need > len(m.pending) {
+		m.pending = append(m.pending, make([]int16, need-len(m.pending))...)
+	}
+	for i, v := range samples {
+		m.pending[(pos-m.flushed+i)*2+track] = float32ToS16(v)
+	}
+	m.cursor[track] = end
+	return m.flush(arrival)
+}
+
+// flush writes out every frame before sample position upto.
+func (m *stereoMixer) flush(upto int) error {
+	n := min(upto-m.flushed, len(m.pending)/2)
+	if n <= 0 {
+		return nil
+	}
+	buf := make([]byte, n*4)
+	for i := 0; i < n*2; i++ {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(m.pending[i]))
+	}
+	m.pending = append(m.pending[:0], m.pending[n*2:]...)
+	m.flushed += n
+	return m.out.Write(buf)
+}
+
+// Close writes the remaining frames and finalizes the WAV.
+func (m *stereoMixer) Close() error {
+	if err := m.flush(m.flushed + len(m.pending)/2); err != nil {
+		m.out.Close()
+		return err
+	}
+	return m.out.Close()
+}
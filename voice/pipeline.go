@@ -0,0 +1,129 @@
+package voice
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// audioPipeline offloads frame decoding to a pool of workers so a slow
+// decode never stalls the client read loop.
+//
+// Ordering guarantee: frames reach Doubao in exactly the order PushAudio
+// received them. Every frame reserves a slot in the order queue before it is
+// handed to a worker, and a single sender goroutine waits on the slots in
+// sequence before resampling (which is stateful and therefore serial) and
+// sending.
+type audioPipeline struct {
+	s     *Session
+	jobs  chan pipelineJob
+	order chan pipelineSlot
+}
+
+type pipelineJob struct {
+	frame  []byte
+	result chan<- decodeResult
+}
+
+type decodeResult struct {
+	samples []float32
+	err     error
+}
+
+// pipelineSlot is either a decoded frame to wait for or a flush marker.
+type pipelineSlot struct {
+	result <-chan decodeResult
+	flush  chan error
+}
+
+func newAudioPipeline(s *Session, workers int) *audioPipeline {
+	p := &audioPipeline{
+		s:     s,
+		jobs:  make(chan pipelineJob, workers),
+		order: make(chan pipelineSlot, 4*workers),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.sendLoop()
+	return p
+}
+
+// push queues a prepared frame, blocking when the pipeline is full.
+func (p *audioPipeline) push(frame []byte) error {
+	result := make(chan decodeResult, 1)
+	select {
+	case p.order <- pipelineSlot{result: result}:
+	case <-p.s.ctx.Done():
+		return p.s.Err()
+	}
+	select {
+	case p.jobs <- pipelineJob{frame: frame, result: result}:
+	case <-p.s.ctx.Done():
+		return p.s.Err()
+	}
+	return nil
+}
+
+// flush waits until every queued frame has been sent, then flushes the
+// resampler tail.
+func (p *audioPipeline) flush() error {
+	done := make(chan error, 1)
+	select {
+	case p.order <- pipelineSlot{flush: done}:
+	case <-p.s.ctx.Done():
+		return p.s.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-p.s.ctx.Done():
+		return p.s.Err()
+	}
+}
+
+func (p *audioPipeline) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			samples, err := p.s.processor.decode(job.frame)
+			job.result <- decodeResult{samples: samples, err: err}
+		case <-p.s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *audioPipeline) sendLoop() {
+	for {
+		var slot pipelineSlot
+		select {
+		case slot = <-p.order:
+		case <-p.s.ctx.Done():
+			return
+		}
+		if slot.flush != nil {
+			slot.flush <- p.s.flushProcessor()
+			continue
+		}
+		var res decodeResult
+		select {
+		case res = <-slot.result:
+		case <-p.s.ctx.Done():
+			return
+		}
+		if res.err != nil {
+			p.s.setError(fmt.Errorf("decode audio: %w", res.err))
+			return
+		}
+		pcm := p.s.processor.resample(res.samples)
+		if len(pcm) == 0 {
+			continue
+		}
+		if err := p.s.sendPCM(pcm); err != nil {
+			glog.Warningf("send pipelined audio: %v", err)
+			p.s.setError(err)
+			return
+		}
+	}
+}
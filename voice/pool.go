@@ -0,0 +1,187 @@
+package voice
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/config"
+	"meow-ai/volc"
+)
+
+// ClientPool keeps up to session.pool.size Doubao clients opened and started
+// ahead of time, so a new session skips the dial and handshakes. Clients are
+// started with the pool's config and not greeted; they are closed once idle
+// for session.pool.idle_ms, before Doubao would time them out.
+type ClientPool struct {
+	cfg  *config.Config
+	size int
+	idle time.Duration
+
+	mu      sync.Mutex
+	clients []pooledClient
+
+	refill chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type pooledClient struct {
+	client *volc.Client
+	opened time.Time
+}
+
+// NewClientPool starts filling a pool for sessions using cfg.
+func NewClientPool(cfg *config.Config) *ClientPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ClientPool{
+		cfg:    cfg,
+		size:   cfg.Session.Pool.Size,
+		idle:   time.Duration(cfg.Session.Pool.IdleMS) * time.Millisecond,
+		refill: make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// Get returns a pre-opened client for cfg, or nil when the pool is empty or
+// cfg differs from the config the pool was started with in more than what
+// an update event can change, in which case the caller opens a client on
+// demand. A different speaker or speaking style is applied to the checked
+// out client with update events.
+func (p *ClientPool) Get(ctx context.Context, cfg *config.Config) *volc.Client {
+	if !p.compatible(cfg) {
+		return nil
+	}
+	client := p.take()
+	if client == nil {
+		return nil
+	}
+	if err := p.configure(ctx, client, cfg); err != nil {
+		glog.Warningf("configure pooled session: %v", err)
+		go closePooled(client)
+		return nil
+	}
+	return client
+}
+
+// compatible reports whether cfg matches the pool's config apart from the
+// settings configure can update.
+func (p *ClientPool) compatible(cfg *config.Config) bool {
+	c := *cfg
+	c.Session.TTS.Speaker = p.cfg.Session.TTS.Speaker
+	c.Session.Dialog.SpeakingStyle = p.cfg.Session.Dialog.SpeakingStyle
+	return reflect.DeepEqual(c, *p.cfg)
+}
+
+func (p *ClientPool) configure(ctx context.Context, client *volc.Client, cfg *config.Config) error {
+	if speaker := cfg.Session.TTS.Speaker; speaker != p.cfg.Session.TTS.Speaker {
+		if err := client.UpdateSpeaker(ctx, speaker); err != nil {
+			return err
+		}
+	}
+	if style := cfg.Session.Dialog.SpeakingStyle; style != p.cfg.Session.Dialog.SpeakingStyle {
+		if err := client.UpdateSpeakingStyle(ctx, style); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take checks out the newest pooled client that is not yet due for
+// eviction and asks for a refill.
+func (p *ClientPool) take() *volc.Client {
+	p.mu.Lock()
+	p.evictLocked(time.Now())
+	var client *volc.Client
+	if n := len(p.clients); n > 0 {
+		client = p.clients[n-1].client
+		p.clients = p.clients[:n-1]
+	}
+	p.mu.Unlock()
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+	return client
+}
+
+// Close stops refilling and closes every pooled client.
+func (p *ClientPool) Close() {
+	p.cancel()
+	p.wg.Wait()
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = nil
+	p.mu.Unlock()
+	for _, c := range clients {
+		closePooled(c.client)
+	}
+}
+
+func (p *ClientPool) run() {
+	defer p.wg.Done()
+	for {
+		p.fill()
+		select {
+		case <-p.refill:
+		case <-time.After(p.idle / 2):
+			p.mu.Lock()
+			p.evictLocked(time.Now())
+			p.mu.Unlock()
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *ClientPool) fill() {
+	for p.ctx.Err() == nil {
+		p.mu.Lock()
+		full := len(p.clients) >= p.size
+		p.mu.Unlock()
+		if full {
+			return
+		}
+		client := volc.NewClient(p.cfg)
+		if err := client.Open(p.ctx); err != nil {
+			glog.Warningf("pre-open doubao session: %v", err)
+			return
+		}
+		p.mu.Lock()
+		p.clients = append(p.clients, pooledClient{client: client, opened: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// evictLocked closes clients idle for longer than the idle timeout. Clients
+// are appended in open order, so the stale ones are at the front.
+func (p *ClientPool) evictLocked(now time.Time) {
+	n := 0
+	for n < len(p.clients) && now.Sub(p.clients[n].opened) >= p.idle {
+		go closePooled(p.clients[n].client)
+		n++
+	}
+	p.clients = p.clients[n:]
+}
+
+func closePooled(client *volc.Client) {
+	if err := client.Close(); err != nil {
+		glog.V(1).Infof("close pooled session: %v", err)
+	}
+}
+
+// WithClient makes the session use an already opened client, typically one
+// checked out of a ClientPool, instead of opening its own.
+func WithClient(client *volc.Client) Option {
+	return func(s *Session) {
+		s.client = client
+	}
+}
@@ -0,0 +1,45 @@
+package voice
+
+import (
+	"time"
+
+	"meow-ai/clock"
+)
+
+// tokenBucket is a byte-based token bucket. It is not safe for concurrent use;
+// the session only consults it from PushAudio.
+type tokenBucket struct {
+	clock  clock.Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(clk clock.Clock, bytesPerSec, burst int) *tokenBucket {
+	return &tokenBucket{
+		clock:  clk,
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clk.Now(),
+	}
+}
+
+// allow consumes n tokens if available. A frame larger than the burst could
+// never fit, so a full bucket admits it and goes into debt, which later
+// refills pay off before anything else is admitted.
+func (b *tokenBucket) allow(n int) bool {
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	need := min(float64(n), b.burst)
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,163 @@
+package voice
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"meow-ai/clock"
+	"meow-ai/config"
+)
+
+// Files written by Recorder inside its session directory.
+const (
+	RecordUserFile   = "user.wav"
+	RecordBotFile    = "bot.wav"
+	RecordEventsFile = "events.jsonl"
+	// RecordMixFile is the stereo mix, written when recorder.mix is set.
+	RecordMixFile = "mix.wav"
+)
+
+// RecordedEvent is one line of events.jsonl.
+type RecordedEvent struct {
+	Time    time.Time       `json:"time"`
+	Type    string          `json:"type"`
+	EventID int32           `json:"event_id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Recorder persists a session's user audio (16 kHz s16 as sent upstream),
+// the bot's TTS audio and every event forwarded to the client, plus an
+// optional stereo mix of the two.
+type Recorder struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	user   *wavWriter
+	bot    *wavWriter
+	events *os.File
+	enc    *json.Encoder
+	mix    *stereoMixer // nil unless recorder.mix is set
+	closed bool
+}
+
+// RecordDir returns the directory a session's recording is stored in.
+func RecordDir(cfg config.RecorderConfig, sessionID string) string {
+	return filepath.Join(cfg.Dir, sessionID)
+}
+
+func newRecorder(cfg *config.Config, sessionID string, clk clock.Clock) (*Recorder, error) {
+	dir := RecordDir(cfg.Session.Recorder, sessionID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create recording dir: %w", err)
+	}
+	user, err := createWAV(filepath.Join(dir, RecordUserFile), wavFormatPCM, targetSampleRate, targetChannels, 16)
+	if err != nil {
+		return nil, fmt.Errorf("create user recording: %w", err)
+	}
+	out := cfg.Session.TTS.AudioConfig
+	botFormat, botBits := wavFormatFloat, 32
+	if out.Format == "pcm_s16le" {
+		botFormat, botBits = wavFormatPCM, 16
+	}
+	bot, err := createWAV(filepath.Join(dir, RecordBotFile), botFormat, out.SampleRate, out.Channel, botBits)
+	if err != nil {
+		user.Close()
+		return nil, fmt.Errorf("create bot recording: %w", err)
+	}
+	events, err := os.Create(filepath.Join(dir, RecordEventsFile))
+	if err != nil {
+		user.Close()
+		bot.Close()
+		return nil, fmt.Errorf("create event log: %w", err)
+	}
+	r := &Recorder{
+		clock:  clk,
+		user:   user,
+		bot:    bot,
+		events: events,
+		enc:    json.NewEncoder(events),
+	}
+	if cfg.Session.Recorder.Mix {
+		mixOut, err := createWAV(filepath.Join(dir, RecordMixFile), wavFormatPCM, targetSampleRate, 2, 16)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("create mixed recording: %w", err)
+		}
+		encoding := EncodingF32
+		if out.Format == "pcm_s16le" {
+			encoding = EncodingS16
+		}
+		r.mix = newStereoMixer(mixOut, clk.Now(), out.SampleRate, out.Channel, encoding)
+	}
+	return r, nil
+}
+
+// WriteUser appends processed user audio.
+func (r *Recorder) WriteUser(pcm []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	if r.mix != nil {
+		if err := r.mix.writeUser(r.clock.Now(), pcm); err != nil {
+			return err
+		}
+	}
+	return r.user.Write(pcm)
+}
+
+// Write appends bot audio, so a Recorder can be used as an AudioSink.
+func (r *Recorder) Write(pcm []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	if r.mix != nil {
+		if err := r.mix.writeBot(r.clock.Now(), pcm); err != nil {
+			return err
+		}
+	}
+	return r.bot.Write(pcm)
+}
+
+// RecordEvent appends an event to the event log.
+func (r *Recorder) RecordEvent(evt EventMsg) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	rec := RecordedEvent{Time: r.clock.Now(), Type: evt.Type, EventID: evt.EventID}
+	if json.Valid(evt.Payload) {
+		rec.Payload = evt.Payload
+	}
+	return r.enc.Encode(rec)
+}
+
+// Close finalizes the WAV headers and closes all files. It is idempotent.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	errUser := r.user.Close()
+	errBot := r.bot.Close()
+	errEvents := r.events.Close()
+	var errMix error
+	if r.mix != nil {
+		errMix = r.mix.Close()
+	}
+	for _, err := range []error{errUser, errBot, errEvents, errMix} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package voice
+
+import "sync"
+
+// turnBuffer is an AudioSink that keeps the TTS audio of the most recent bot
+// turn, up to max bytes, for replay_last. Audio past the bound is dropped so
+// a long reply replays its beginning.
+type turnBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func newTurnBuffer(max int) *turnBuffer {
+	return &turnBuffer{max: max}
+}
+
+// reset starts a new turn.
+func (b *turnBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	audioMemory.release(len(b.buf))
+	b.buf = b.buf[:0]
+}
+
+func (b *turnBuffer) Write(p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - len(b.buf); room < len(p) {
+		p = p[:max(room, 0)]
+	}
+	if !audioMemory.reserve(len(p)) {
+		return nil // at the memory cap the replay is cut short
+	}
+	b.buf = append(b.buf, p...)
+	return nil
+}
+
+func (b *turnBuffer) Close() error {
+	b.reset()
+	return nil
+}
+
+func (b *turnBuffer) snapshot() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]byte, len(b.buf))
+	copy(out, b.buf)
+	return out
+}
+
+// LastTurn returns the TTS audio of the most recent bot turn, in the
+// session's output format. It is empty before the bot has spoken.
+func (s *Session) LastTurn() []byte {
+	return s.lastTurn.snapshot()
+}
@@ -2,73 +2,290 @@ package voice
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 
+	"meow-ai/clock"
 	"meow-ai/config"
+	"meow-ai/metrics"
 	"meow-ai/volc"
 )
 
+// Values of session.dialog.extra.input_mod.
+const (
+	InputModAudio = "audio"
+	InputModText  = "text"
+)
+
+// Doubao server events the session reacts to.
+const (
+	eventTTSSentenceStart int32 = 350 // bot started speaking a sentence
+	eventTTSEnded         int32 = 359 // bot finished speaking the reply
+	eventASRInfo          int32 = 450 // first word of user speech recognized, used for barge-in
+	eventASRResponse      int32 = 451 // user speech recognition result
+	eventASREnded         int32 = 459 // user finished speaking
+	eventChatResponse     int32 = 550 // incremental bot text reply
+	eventChatEnded        int32 = 559 // bot text reply finished
+)
+
 type EventMsg struct {
 	Type    string `json:"type"`
 	EventID int32  `json:"event_id"`
 	Payload []byte `json:"payload"` // Raw JSON payload
 }
 
+// Option customizes a Session created by NewSession.
+type Option func(*Session)
+
+// WithClock makes the session and its Doubao client use clk instead of the
+// wall clock.
+func WithClock(clk clock.Clock) Option {
+	return func(s *Session) {
+		s.clock = clk
+	}
+}
+
+// WithThinking forwards the model's intermediate reasoning as "thinking"
+// events. It is off by default since simple clients have no use for it.
+func WithThinking() Option {
+	return func(s *Session) {
+		s.thinking = true
+	}
+}
+
+// WithASROnly restricts the session to recognition: bot audio is dropped and
+// only ASR events reach the client. Doubao still runs the dialog, since it
+// cannot be disabled on every resource, but its output is suppressed.
+func WithASROnly() Option {
+	return func(s *Session) {
+		s.asrOnly = true
+	}
+}
+
 type Session struct {
+	cfg       *config.Config
 	client    *volc.Client
 	processor *PCMProcessor
+	clock     clock.Clock
+
+	pipeline    *audioPipeline
+	limiter     *tokenBucket
+	rateLimit   int
+	rateLimited bool // inside a rate-limited episode, only touched by PushAudio
+	stats       sessionStats
+	// lastAudio is the UnixNano time of the last frame sent upstream.
+	lastAudio atomic.Int64
+	// lastActivity is the UnixNano time of the last message from Doubao or
+	// input from the client.
+	lastActivity atomic.Int64
+	// readingSince is the UnixNano time consume entered the Read in
+	// progress, 0 between reads.
+	readingSince atomic.Int64
+	// awaitingSince is the UnixNano time of the first input Doubao must
+	// answer sent since its last message, 0 when none is outstanding.
+	awaitingSince atomic.Int64
+	// sentBytes counts user audio sent upstream, the caption timeline.
+	sentBytes atomic.Int64
 
 	audioCh chan []byte
-	eventCh chan EventMsg
+	// audioOut is what Audio returns; forwardAudio moves frames to it from
+	// audioCh and releases their memory accounting.
+	audioOut chan []byte
+	// eventCh is closed by consume once the session ends; eventMu and
+	// eventsClosed keep the senders outside consume from sending after that.
+	eventCh      chan EventMsg
+	eventMu      sync.Mutex
+	eventsClosed bool
+	// sinks receive TTS audio alongside audioCh; owned by consume.
+	sinks    []AudioSink
+	recorder *Recorder
+	lastTurn *turnBuffer
+	// eventLog keeps the last forwarded events; nil when disabled.
+	eventLog *eventLog
+	// integrity checks audio message seq and crc; nil when disabled.
+	integrity *integrityCheck
+	// webhook receives final transcripts, masked by webhookRedact; nil
+	// without session.asr.webhook_url.
+	webhook       *transcriptWebhook
+	webhookRedact []*regexp.Regexp
+
+	thinking bool
+	asrOnly  bool
+
+	// fallback speaks replies that arrive without audio; nil when off.
+	// turnAudio is set by the reply's kept TTS frames and cleared when the
+	// user's turn ends. fallbackGen is bumped on barge-in, which cancels the
+	// watches started before it.
+	fallback    FallbackTTS
+	fallbackWG  sync.WaitGroup
+	turnAudio   atomic.Bool
+	fallbackGen atomic.Int64
+
+	// announceMu guards the barge-in state used by Announce. speaking is
+	// set between TTS start and end; while discarding, the interrupted
+	// reply's audio is dropped until Doubao ends it, then pendingAnnounce is
+	// spoken.
+	announceMu      sync.Mutex
+	speaking        bool
+	discarding      bool
+	pendingAnnounce string
+	// stopping is set by Stop, also under announceMu; finishOnce sends
+	// FinishSession once for Stop and Close.
+	stopping   bool
+	finishOnce sync.Once
+	// turns counts user turns for session.max_turns, under announceMu.
+	// finalTurn is set when the last allowed turn ended and finalReply once
+	// its reply started; the session stops when that reply ends.
+	turns      int
+	finalTurn  bool
+	finalReply bool
+	// replyOwed is set, under announceMu, from input Doubao must answer
+	// until that reply ended; replyIdle is closed when it ends.
+	replyOwed bool
+	replyIdle chan struct{}
+	// greeting is set while the greeting turn plays; loudFrames counts
+	// consecutive loud user frames for the local barge-in check.
+	greeting   atomic.Bool
+	loudFrames int
+
+	// language is the last detected user language, only touched by
+	// consume. speaker is the current TTS voice, guarded by speakerMu since
+	// SetSpeaker also changes it.
+	language  string
+	speakerMu sync.Mutex
+	speaker   string
+
+	// Caption state for the utterance being recognized, only touched by
+	// consume; captions itself is guarded by captionMu.
+	captionOpen  bool
+	captionStart time.Duration
+	captionEnd   time.Duration
+	captionMu    sync.Mutex
+	captions     []Caption
+
+	// botText accumulates the streamed reply of the current turn. It is only
+	// touched by consume.
+	botText strings.Builder
 
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
+	dropMu     sync.Mutex
+	dropWindow time.Time
+	dropCount  int
+
 	errMu sync.Mutex
 	err   error
 }
 
-func NewSession(parent context.Context, cfg *config.Config, format InputFormat) (*Session, error) {
-	processor, err := NewPCMProcessor(format)
-	if err != nil {
-		return nil, err
+// ErrTextMode is returned by PushAudio when the session runs with
+// input_mod "text" and therefore has no audio path.
+var ErrTextMode = errors.New("session input_mod is text, binary audio is not accepted")
+
+func NewSession(parent context.Context, cfg *config.Config, format InputFormat, opts ...Option) (*Session, error) {
+	var processor *PCMProcessor
+	if cfg.Session.Dialog.Extra.InputMod != InputModText {
+		var err error
+		if processor, err = NewPCMProcessor(format); err != nil {
+			return nil, err
+		}
+	}
+	s := &Session{
+		cfg:       cfg,
+		processor: processor,
+		clock:     clock.Real,
+		audioCh:   make(chan []byte, cfg.Session.AudioBuffer),
+		audioOut:  make(chan []byte),
+		eventCh:   make(chan EventMsg, cfg.Session.EventBuffer),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.fallback == nil {
+		s.fallback = newFallbackTTS(cfg.Session.TTS)
+	}
+	if rl := cfg.Session.AudioRateLimit; rl.BytesPerSec > 0 {
+		s.rateLimit = rl.BytesPerSec
+		s.limiter = newTokenBucket(s.clock, rl.BytesPerSec, rl.BurstBytes)
 	}
-	client := volc.NewClient(cfg)
+
 	ctx, cancel := context.WithCancel(parent)
+	client := s.client
+	if client == nil {
+		client = volc.NewClient(cfg)
+		client.SetClock(s.clock)
+		if err := client.Open(ctx); err != nil {
+			cancel()
+			return nil, fmt.Errorf("open doubao session: %w", err)
+		}
+		s.client = client
+	} else {
+		client.SetClock(s.clock)
+	}
+	s.ctx = ctx
+	s.cancel = cancel
 
-	if err := client.Open(ctx); err != nil {
-		cancel()
-		return nil, fmt.Errorf("open doubao session: %w", err)
+	if workers := cfg.Session.ASR.ProcessWorkers; workers > 0 && processor != nil {
+		s.pipeline = newAudioPipeline(s, workers)
 	}
-	greeting := fmt.Sprintf("你好，我是%s，有什么可以帮助你的吗？", cfg.Session.Dialog.BotName)
-	if err := client.SayHello(ctx, greeting); err != nil {
-		cancel()
-		client.Close()
-		return nil, fmt.Errorf("send greeting: %w", err)
+
+	s.speaker = cfg.Session.TTS.Speaker
+	s.lastTurn = newTurnBuffer(cfg.Session.TTS.ReplayMaxBytes)
+	if size := cfg.Session.EventLogSize; size > 0 {
+		s.eventLog = newEventLog(size)
+	}
+	if cfg.Session.AudioIntegrity {
+		s.integrity = &integrityCheck{}
 	}
+	if cfg.Session.ASR.WebhookURL != "" {
+		s.webhook = webhookFor(cfg.Session.ASR)
+		s.webhookRedact = redactPatterns(cfg.Session.ASR.WebhookRedact)
+	}
+	s.sinks = append(s.sinks, s.lastTurn)
 
-	s := &Session{
-		client:    client,
-		processor: processor,
-		audioCh:   make(chan []byte, 64),
-		eventCh:   make(chan EventMsg, 64),
-		ctx:       ctx,
-		cancel:    cancel,
+	if cfg.Session.Recorder.Enabled {
+		recorder, err := newRecorder(cfg, client.SessionID(), s.clock)
+		if err != nil {
+			glog.Warningf("session recording disabled: %v", err)
+		} else {
+			s.recorder = recorder
+			s.sinks = append(s.sinks, recorder)
+		}
 	}
 
-	s.wg.Add(1)
+	s.emitJSON("session_info", 0, SessionInfo{SessionID: s.ID(), DialogID: s.DialogID()})
+
+	s.lastAudio.Store(s.clock.Now().UnixNano())
+	s.touch()
+	s.wg.Add(2)
 	go s.consume()
+	go s.forwardAudio()
+	if ms := cfg.Session.KeepAliveIntervalMS; ms > 0 && processor != nil {
+		s.wg.Add(1)
+		go s.keepAlive(time.Duration(ms) * time.Millisecond)
+	}
+	if ms := cfg.Session.ReadStallTimeoutMS; ms > 0 {
+		s.wg.Add(1)
+		go s.watchReads(time.Duration(ms) * time.Millisecond)
+	}
 	return s, nil
 }
 
 func (s *Session) consume() {
 	defer s.wg.Done()
+	defer s.closeSinks()
 	defer close(s.audioCh)
-	defer close(s.eventCh)
+	defer s.closeEvents()
+	defer s.fallbackWG.Wait()
 
 	for {
 		select {
@@ -76,18 +293,33 @@ func (s *Session) consume() {
 			return
 		default:
 		}
+		s.readingSince.Store(s.clock.Now().UnixNano())
 		msg, err := s.client.Read(s.ctx)
+		s.readingSince.Store(0)
 		if err != nil {
 			s.setError(fmt.Errorf("read from doubao: %w", err))
 			return
 		}
+		s.awaitingSince.Store(0)
+		s.touch()
 		switch msg.Type {
 		case volc.MsgTypeAudioOnlyServer:
+			if s.asrOnly || !s.cfg.Session.TTS.AudioEnabled() || s.discardingAudio() {
+				continue
+			}
+			s.turnAudio.Store(true)
 			payload := make([]byte, len(msg.Payload))
 			copy(payload, msg.Payload)
+			s.writeSinks(payload)
+			if !audioMemory.reserve(len(payload)) {
+				s.stats.memoryDrops.Add(1)
+				metrics.AudioMemoryDrops.Add(1)
+				continue
+			}
 			select {
 			case s.audioCh <- payload:
 			case <-s.ctx.Done():
+				audioMemory.release(len(payload))
 				return
 			}
 		case volc.MsgTypeFullServer:
@@ -95,22 +327,43 @@ func (s *Session) consume() {
 				glog.Infof("doubao session closed event=%d", msg.Event)
 				return
 			}
+			switch msg.Event {
+			case eventTTSSentenceStart:
+				s.setSpeaking()
+			case eventTTSEnded:
+				s.finishSpeaking()
+			case eventASRInfo:
+				s.cancelFallback()
+				s.drainAudio()
+				s.interruptGreeting()
+			case eventASRResponse:
+				s.handleASRResponse(msg.Payload)
+			case eventASREnded:
+				s.turnAudio.Store(false)
+				s.expectReply()
+				s.countTurn()
+				s.reportIntegrity()
+			case eventChatResponse:
+				s.handleChatResponse(msg.Payload)
+			case eventChatEnded:
+				s.handleChatEnded()
+			}
 			// Forward relevant events to frontend
 			// Copy payload to be safe
 			payload := make([]byte, len(msg.Payload))
 			copy(payload, msg.Payload)
 
-			select {
-			case s.eventCh <- EventMsg{
+			s.emit(EventMsg{
 				Type:    "event",
 				EventID: msg.Event,
 				Payload: payload,
-			}:
-			default:
-				glog.Warningf("event channel full, dropping event %d", msg.Event)
-			}
+			})
 
 		case volc.MsgTypeError:
+			if err := s.client.RateLimitFromMessage(msg); err != nil {
+				s.setError(err)
+				return
+			}
 			s.setError(fmt.Errorf("doubao error code=%d payload=%s", msg.ErrorCode, string(msg.Payload)))
 			return
 		default:
@@ -119,6 +372,159 @@ func (s *Session) consume() {
 	}
 }
 
+// emit forwards an event to the frontend without blocking the read loop.
+func (s *Session) emit(evt EventMsg) {
+	if s.recorder != nil {
+		if err := s.recorder.RecordEvent(evt); err != nil {
+			glog.Warningf("record event: %v", err)
+		}
+	}
+	if s.asrOnly && !isASREvent(evt) {
+		return
+	}
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if s.eventsClosed {
+		return
+	}
+	select {
+	case s.eventCh <- evt:
+		if s.eventLog != nil {
+			s.eventLog.add(evt, s.clock.Now())
+		}
+	default:
+		glog.Warningf("event channel full, dropping event type=%s id=%d", evt.Type, evt.EventID)
+		s.recordDrop()
+	}
+}
+
+// closeEvents closes eventCh; later emits are dropped.
+func (s *Session) closeEvents() {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	s.eventsClosed = true
+	close(s.eventCh)
+}
+
+// asrEventTypes are the synthesized events an ASR-only session forwards.
+var asrEventTypes = map[string]bool{
+	"session_info": true,
+	"user_text":    true,
+	"asr":          true,
+	"caption":      true,
+	"language":     true,
+	"degraded":     true,
+	"rate_limited": true,
+}
+
+func isASREvent(evt EventMsg) bool {
+	if evt.Type == "event" {
+		return evt.EventID >= eventASRInfo && evt.EventID < eventChatResponse
+	}
+	return asrEventTypes[evt.Type]
+}
+
+// recordDrop counts a dropped event and, once the drops in the current window
+// reach session.degraded.threshold, tells the client the session is
+// overloaded. The degraded event takes the place of a droppable queued event
+// so it is delivered even though the channel is full. It runs under eventMu.
+func (s *Session) recordDrop() {
+	metrics.EventsDropped.Add(1)
+	cfg := s.cfg.Session.Degraded
+	now := s.clock.Now()
+
+	s.dropMu.Lock()
+	if now.Sub(s.dropWindow) > time.Duration(cfg.WindowMS)*time.Millisecond {
+		s.dropWindow = now
+		s.dropCount = 0
+	}
+	s.dropCount++
+	degraded := s.dropCount == cfg.Threshold
+	s.dropMu.Unlock()
+	if !degraded {
+		return
+	}
+
+	metrics.SessionsDegraded.Add(1)
+	glog.Errorf("session %s degraded: %d events dropped within %dms", s.client.SessionID(), cfg.Threshold, cfg.WindowMS)
+	payload, _ := json.Marshal(map[string]any{"dropped": cfg.Threshold, "window_ms": cfg.WindowMS})
+	evicted := s.evictDroppable()
+	select {
+	case s.eventCh <- EventMsg{Type: "degraded", Payload: payload}:
+	default:
+		if !evicted {
+			glog.Errorf("session %s: no droppable event queued, degraded event not delivered", s.client.SessionID())
+		}
+	}
+}
+
+// evictDroppable removes the oldest droppable event from eventCh, keeping
+// the others in order. It runs under eventMu, so only the frontend takes
+// events meanwhile and the requeue always fits.
+func (s *Session) evictDroppable() bool {
+	queued := make([]EventMsg, 0, len(s.eventCh))
+drain:
+	for {
+		select {
+		case evt := <-s.eventCh:
+			queued = append(queued, evt)
+		default:
+			break drain
+		}
+	}
+	evicted := false
+	for _, evt := range queued {
+		if !evicted && isDroppable(evt) {
+			evicted = true
+			continue
+		}
+		s.eventCh <- evt
+	}
+	return evicted
+}
+
+// isDroppable reports whether losing evt loses nothing the client needs:
+// reasoning text, and raw ASR and chat events that user_text, asr and
+// bot_text already carry.
+func isDroppable(evt EventMsg) bool {
+	switch evt.Type {
+	case "thinking":
+		return true
+	case "event":
+		return evt.EventID == eventASRResponse || evt.EventID == eventChatResponse
+	}
+	return false
+}
+
+// drainAudio discards TTS audio still queued for the frontend and tells the
+// client to clear its playback buffer. Frames consume sends concurrently
+// either land before the drain and are dropped or after it and are kept.
+// Once the session has ended audioCh is closed and forwardAudio owns the
+// leftovers, so there is nothing to drain.
+func (s *Session) drainAudio() {
+	if s.ctx.Err() != nil {
+		return
+	}
+	dropped := 0
+drain:
+	for {
+		select {
+		case frame, ok := <-s.audioCh:
+			if !ok {
+				break drain
+			}
+			audioMemory.release(len(frame))
+			dropped++
+		default:
+			break drain
+		}
+	}
+	if dropped > 0 {
+		glog.V(1).Infof("barge-in drained %d queued audio frames", dropped)
+	}
+	s.emit(EventMsg{Type: "audio_flush"})
+}
+
 func (s *Session) setError(err error) {
 	if err == nil {
 		return
@@ -132,7 +538,21 @@ func (s *Session) setError(err error) {
 }
 
 func (s *Session) Audio() <-chan []byte {
-	return s.audioCh
+	return s.audioOut
+}
+
+// forwardAudio hands queued frames to the frontend, releasing each frame's
+// memory once it is taken. After the session ends it drops what is left.
+func (s *Session) forwardAudio() {
+	defer s.wg.Done()
+	defer close(s.audioOut)
+	for frame := range s.audioCh {
+		select {
+		case s.audioOut <- frame:
+		case <-s.ctx.Done():
+		}
+		audioMemory.release(len(frame))
+	}
 }
 
 func (s *Session) Events() <-chan EventMsg {
@@ -148,6 +568,28 @@ func (s *Session) PushAudio(frame []byte) error {
 		return s.Err()
 	default:
 	}
+	if s.processor == nil {
+		return ErrTextMode
+	}
+	s.touch()
+	if s.limiter != nil && !s.limiter.allow(len(frame)) {
+		s.stats.droppedFrames.Add(1)
+		s.stats.droppedBytes.Add(uint64(len(frame)))
+		if !s.rateLimited {
+			s.rateLimited = true
+			glog.Warningf("session audio exceeds %d bytes/sec, dropping frames", s.rateLimit)
+			s.emitJSON("rate_limited", 0, map[string]any{"bytes_per_sec": s.rateLimit})
+		}
+		return nil
+	}
+	s.rateLimited = false
+	if s.pipeline != nil {
+		frame, err := s.processor.prepare(frame)
+		if err != nil || len(frame) == 0 {
+			return err
+		}
+		return s.pipeline.push(frame)
+	}
 	pcm, err := s.processor.Process(frame)
 	if err != nil {
 		return err
@@ -155,15 +597,299 @@ func (s *Session) PushAudio(frame []byte) error {
 	if len(pcm) == 0 {
 		return nil
 	}
+	return s.sendPCM(pcm)
+}
+
+// sendPCM forwards processed 16 kHz audio upstream, recording it if enabled.
+func (s *Session) sendPCM(pcm []byte) error {
+	if s.recorder != nil {
+		if err := s.recorder.WriteUser(pcm); err != nil {
+			glog.Warningf("record user audio: %v", err)
+		}
+	}
+	s.lastAudio.Store(s.clock.Now().UnixNano())
+	s.sentBytes.Add(int64(len(pcm)))
+	s.checkGreetingBargeIn(pcm)
 	return s.client.SendAudio(s.ctx, pcm)
 }
 
+// keepAlive sends a keep-alive frame whenever no audio has gone upstream for
+// interval. It only fills silences, so it never lands inside an utterance.
+func (s *Session) keepAlive(interval time.Duration) {
+	defer s.wg.Done()
+	wait := interval
+	for {
+		select {
+		case <-s.clock.After(wait):
+		case <-s.ctx.Done():
+			return
+		}
+		idle := s.clock.Now().Sub(time.Unix(0, s.lastAudio.Load()))
+		if idle < interval {
+			wait = interval - idle
+			continue
+		}
+		if err := s.client.SendKeepAlive(s.ctx); err != nil {
+			glog.Warningf("send keepalive: %v", err)
+		}
+		wait = interval
+	}
+}
+
+// Flush sends any audio still buffered in the processing path to Doubao so
+// the tail of an utterance is not lost when the client stops sending.
+func (s *Session) Flush() error {
+	if s.processor == nil {
+		return nil
+	}
+	if s.pipeline != nil {
+		return s.pipeline.flush()
+	}
+	return s.flushProcessor()
+}
+
+func (s *Session) flushProcessor() error {
+	pcm := s.processor.Flush()
+	if len(pcm) == 0 {
+		return nil
+	}
+	return s.sendPCM(pcm)
+}
+
+// FinishInput ends the user's turn: buffered audio is flushed upstream and
+// Doubao is told the utterance is complete. Push-to-talk clients use it on
+// release instead of relying on silence detection.
+func (s *Session) FinishInput() error {
+	if s.processor == nil {
+		return ErrTextMode
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.expectReply()
+	return s.client.EndASR(s.ctx)
+}
+
+// Greet announces the bot with a "speaking" event and asks Doubao to say
+// the greeting. NewSession does not greet on its own so the caller can wait
+// until the client is ready to play audio. The greeting is an interruptible
+// turn: user speech cuts it like any other reply. With greeting_mode "text" the
+// greeting is only sent as a final bot_text event, and "none" skips it.
+//
+// A greeting Doubao refuses is not fatal: the user can still talk, so the
+// failure, including a greeting that takes longer than greeting_timeout_ms,
+// is reported as a greeting_failed event and Greet returns nil. It only
+// fails once the session itself has ended.
+func (s *Session) Greet() error {
+	greeting := greetingText(s.cfg.Session.Dialog)
+	mode := s.cfg.Session.Dialog.GreetingMode
+	if !s.cfg.Session.TTS.AudioEnabled() && mode == config.GreetingModeAudio {
+		mode = config.GreetingModeText
+	}
+	switch mode {
+	case config.GreetingModeNone:
+		return nil
+	case config.GreetingModeText:
+		s.emitJSON("bot_text", 0, TextPayload{Text: greeting, Full: greeting, Final: true})
+		return nil
+	}
+	s.startGreeting()
+	s.emit(EventMsg{Type: "speaking"})
+	if err := s.sayHello(greeting); err != nil {
+		if s.ctx.Err() != nil {
+			return fmt.Errorf("send greeting: %w", err)
+		}
+		glog.Warningf("session %s: send greeting: %v", s.ID(), err)
+		s.finishSpeaking()
+		s.emitJSON("greeting_failed", 0, map[string]any{"error": err.Error()})
+	}
+	return nil
+}
+
+// Announce speaks text right away, interrupting the bot reply in progress.
+// Queued reply audio is flushed like a user barge-in; if the bot is still
+// speaking, the rest of that reply is discarded and the announcement is sent
+// once Doubao ends it, after which the dialog carries on normally. User audio
+// keeps flowing throughout, so a turn the user is speaking is not lost.
+func (s *Session) Announce(text string) error {
+	if text == "" {
+		return nil
+	}
+	if s.interrupt(text) {
+		return nil
+	}
+	return s.say(text)
+}
+
+// Interrupt stops the bot reply in progress as if the user had barged in:
+// queued audio is flushed and the rest of the reply is discarded. The
+// dialog continues with the next user turn.
+func (s *Session) Interrupt() {
+	s.interrupt("")
+}
+
+// interrupt flushes queued reply audio and, if the bot is still speaking,
+// discards the rest of the reply and queues announce for when it ends. It
+// reports whether a reply was interrupted.
+func (s *Session) interrupt(announce string) bool {
+	s.cancelFallback()
+	s.drainAudio()
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	if !s.speaking {
+		return false
+	}
+	s.discarding = true
+	s.pendingAnnounce = announce
+	return true
+}
+
+func (s *Session) say(text string) error {
+	s.emit(EventMsg{Type: "speaking"})
+	s.expectReply()
+	if err := s.client.SayHello(s.ctx, text); err != nil {
+		return fmt.Errorf("send announcement: %w", err)
+	}
+	return nil
+}
+
+func (s *Session) discardingAudio() bool {
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	return s.discarding
+}
+
+// setSpeaking runs on every TTS sentence start; the first one of a turn
+// resets the replay buffer.
+func (s *Session) setSpeaking() {
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	if !s.speaking {
+		s.lastTurn.reset()
+		if s.finalTurn {
+			s.finalTurn, s.finalReply = false, true
+		}
+	}
+	s.speaking = true
+}
+
+// finishSpeaking runs on TTS end and sends an announcement that was waiting
+// for the interrupted reply to end.
+func (s *Session) finishSpeaking() {
+	s.announceMu.Lock()
+	text := s.pendingAnnounce
+	s.speaking, s.discarding, s.pendingAnnounce = false, false, ""
+	s.greeting.Store(false)
+	stopping := s.stopping || s.finalReply
+	s.endReplyLocked()
+	s.announceMu.Unlock()
+	if stopping {
+		s.finish()
+		return
+	}
+	if text == "" {
+		return
+	}
+	if err := s.say(text); err != nil {
+		glog.Warningf("%v", err)
+		s.setError(err)
+	}
+}
+
+// SendText sends a typed user turn. It works in both input modes and is the
+// only input in text mode.
+func (s *Session) SendText(text string) error {
+	if text == "" {
+		return nil
+	}
+	s.touch()
+	s.turnAudio.Store(false)
+	s.expectReply()
+	s.countTurn()
+	return s.client.SendText(s.ctx, text)
+}
+
+// InjectContext tells the model about out-of-band context (for example
+// "the user opened the checkout page") without creating a user turn. The reply
+// may reflect it but Doubao does not speak it back verbatim.
+func (s *Session) InjectContext(text string) error {
+	if text == "" {
+		return nil
+	}
+	return s.client.SendSystemEvent(s.ctx, text)
+}
+
+// closeTimeout bounds how long Close waits for Doubao to acknowledge
+// FinishSession before the connection is aborted.
+const closeTimeout = 3 * time.Second
+
+// Close finishes the Doubao session and waits for the read loop to observe
+// SessionFinished, then tears down the connection.
 func (s *Session) Close() error {
 	s.cancel()
-	s.wg.Wait()
+	s.finish()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-s.clock.After(closeTimeout):
+		glog.Warningf("doubao session did not finish within %s, aborting", closeTimeout)
+		_ = s.client.Abort()
+		<-done
+	}
 	return s.client.Close()
 }
 
+// Ping reports whether the session loop is still running, returning the
+// error that ended it otherwise.
+func (s *Session) Ping() error {
+	select {
+	case <-s.ctx.Done():
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return s.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// ID returns the Doubao session ID.
+func (s *Session) ID() string {
+	return s.client.SessionID()
+}
+
+func (s *Session) touch() {
+	s.lastActivity.Store(s.clock.Now().UnixNano())
+}
+
+// IdleFor returns how long the session has seen no Doubao message and no
+// client input.
+func (s *Session) IdleFor() time.Duration {
+	return s.clock.Now().Sub(time.Unix(0, s.lastActivity.Load()))
+}
+
+// DialogID returns the dialog the session resumed, empty for a new dialog.
+func (s *Session) DialogID() string {
+	return s.cfg.Session.Dialog.DialogID
+}
+
+// SessionInfo is the payload of the session_info event, sent first on every
+// session so clients can correlate it with Doubao-side analytics.
+type SessionInfo struct {
+	SessionID string `json:"session_id"`
+	DialogID  string `json:"dialog_id,omitempty"`
+}
+
+// Endpoint returns the Doubao endpoint the session is connected to.
+func (s *Session) Endpoint() string {
+	return s.client.Endpoint()
+}
+
 func (s *Session) Err() error {
 	s.errMu.Lock()
 	defer s.errMu.Unlock()
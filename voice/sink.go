@@ -0,0 +1,45 @@
+package voice
+
+import (
+	"github.com/golang/glog"
+)
+
+// AudioSink receives the bot's TTS audio in the session's output format.
+// Write is called from the session read loop, so implementations must return
+// quickly and buffer internally if they do slow I/O.
+type AudioSink interface {
+	Write(pcm []byte) error
+	Close() error
+}
+
+// WithSinks adds sinks that receive a copy of every TTS frame in addition to
+// the Audio channel.
+func WithSinks(sinks ...AudioSink) Option {
+	return func(s *Session) {
+		s.sinks = append(s.sinks, sinks...)
+	}
+}
+
+// writeSinks fans a frame out to the sinks. A sink that fails is closed and
+// removed so a broken tap never ends the conversation.
+func (s *Session) writeSinks(pcm []byte) {
+	kept := s.sinks[:0]
+	for _, sink := range s.sinks {
+		if err := sink.Write(pcm); err != nil {
+			glog.Warningf("audio sink %T failed, removing: %v", sink, err)
+			_ = sink.Close()
+			continue
+		}
+		kept = append(kept, sink)
+	}
+	s.sinks = kept
+}
+
+func (s *Session) closeSinks() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			glog.Warningf("close audio sink %T: %v", sink, err)
+		}
+	}
+	s.sinks = nil
+}
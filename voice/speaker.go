@@ -0,0 +1,59 @@
+package voice
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"meow-ai/config"
+)
+
+// ErrSpeakerNotAllowed is returned by SetSpeaker for a speaker outside
+// session.tts.allowed_speakers or one the dialog model cannot synthesize.
+var ErrSpeakerNotAllowed = errors.New("speaker not allowed")
+
+// SetSpeaker switches the TTS voice for the following replies without
+// reconnecting, e.g. to voice another character in a story. Doubao applies
+// the update to replies it synthesizes afterwards: a reply that is already
+// playing finishes in the previous voice and the next one uses the new
+// voice. The configured speaker and the language_speakers are always
+// allowed. A later language switch still applies on top.
+func (s *Session) SetSpeaker(speaker string) error {
+	if err := s.checkSpeaker(speaker); err != nil {
+		return err
+	}
+	if _, err := s.switchSpeaker(speaker); err != nil {
+		return fmt.Errorf("update speaker: %w", err)
+	}
+	return nil
+}
+
+func (s *Session) checkSpeaker(speaker string) error {
+	tts := s.cfg.Session.TTS
+	known := speaker == tts.Speaker
+	for _, sp := range tts.LanguageSpeakers {
+		known = known || sp == speaker
+	}
+	if !known && len(tts.AllowedSpeakers) > 0 && !slices.Contains(tts.AllowedSpeakers, speaker) {
+		return fmt.Errorf("%w: %q is not in session.tts.allowed_speakers", ErrSpeakerNotAllowed, speaker)
+	}
+	if err := config.CheckSpeakerModel(speaker, s.cfg.Session.Dialog.Extra.Model); err != nil {
+		return fmt.Errorf("%w: %v", ErrSpeakerNotAllowed, err)
+	}
+	return nil
+}
+
+// switchSpeaker sends the speaker update unless it is already current and
+// reports whether it did.
+func (s *Session) switchSpeaker(speaker string) (bool, error) {
+	s.speakerMu.Lock()
+	defer s.speakerMu.Unlock()
+	if speaker == s.speaker {
+		return false, nil
+	}
+	if err := s.client.UpdateSpeaker(s.ctx, speaker); err != nil {
+		return false, err
+	}
+	s.speaker = speaker
+	return true, nil
+}
@@ -0,0 +1,39 @@
+package voice
+
+import "sync/atomic"
+
+type sessionStats struct {
+	droppedFrames atomic.Uint64
+	droppedBytes  atomic.Uint64
+	memoryDrops   atomic.Uint64
+}
+
+// Stats is a snapshot of per-session counters.
+type Stats struct {
+	// AudioRateLimit is the configured bytes/sec cap, 0 when unlimited.
+	AudioRateLimit     int    `json:"audio_rate_limit"`
+	DroppedAudioFrames uint64 `json:"dropped_audio_frames"`
+	DroppedAudioBytes  uint64 `json:"dropped_audio_bytes"`
+	// MemoryDroppedFrames counts TTS frames dropped at the global audio
+	// memory cap.
+	MemoryDroppedFrames uint64 `json:"memory_dropped_frames"`
+	// Resampler is nil in text mode.
+	Resampler *ResamplerCounters `json:"resampler,omitempty"`
+}
+
+// Stats returns a snapshot of the session counters. It is safe to call
+// concurrently with the session's pipelines.
+func (s *Session) Stats() Stats {
+	st := Stats{
+		AudioRateLimit:     s.rateLimit,
+		DroppedAudioFrames: s.stats.droppedFrames.Load(),
+		DroppedAudioBytes:  s.stats.droppedBytes.Load(),
+
+		MemoryDroppedFrames: s.stats.memoryDrops.Load(),
+	}
+	if s.processor != nil {
+		counters := s.processor.Counters()
+		st.Resampler = &counters
+	}
+	return st
+}
@@ -0,0 +1,91 @@
+package voice
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+)
+
+// Stop starts a clean end of the session after the client stopped sending.
+// The reply owed to the client's last input, if any, is allowed to finish
+// even when it has not started playing; then Doubao is asked to finish the
+// session. consume reads the rest of the reply and returns on
+// SessionFinished without canceling the session, so every queued frame and
+// event still reaches Audio and Events before they close. The caller bounds
+// the wait and calls Close either way.
+func (s *Session) Stop() {
+	s.announceMu.Lock()
+	s.stopping = true
+	s.pendingAnnounce = ""
+	// An ASR-only client never hears the reply, so there is nothing to wait
+	// for.
+	waiting := (s.speaking || s.replyOwed) && !s.asrOnly
+	s.announceMu.Unlock()
+	if !waiting {
+		s.finish()
+	}
+}
+
+// expectReply records that input Doubao must answer was sent: a finished
+// user turn, typed text, end of input or a greeting. Stop and ReplyIdle wait
+// for that reply, and the stall watchdog times it; only the first input
+// since Doubao's last message counts, so a stream of inputs cannot push the
+// deadline out.
+func (s *Session) expectReply() {
+	s.awaitingSince.CompareAndSwap(0, s.clock.Now().UnixNano())
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	if !s.replyOwed {
+		s.replyOwed = true
+		s.replyIdle = make(chan struct{})
+	}
+}
+
+// endReplyLocked marks the owed reply as ended; announceMu must be held.
+func (s *Session) endReplyLocked() {
+	if s.replyOwed {
+		s.replyOwed = false
+		close(s.replyIdle)
+	}
+}
+
+// endTextReply ends a reply the client only receives as text, which has no
+// TTS end to wait for.
+func (s *Session) endTextReply() {
+	s.announceMu.Lock()
+	stopping := s.stopping
+	s.endReplyLocked()
+	s.announceMu.Unlock()
+	if stopping {
+		s.finish()
+	}
+}
+
+// idle is returned by ReplyIdle when no reply is owed.
+var idle = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// ReplyIdle is closed once the reply owed to the client's last input
+// finished playing; it is already closed when none is owed.
+func (s *Session) ReplyIdle() <-chan struct{} {
+	s.announceMu.Lock()
+	defer s.announceMu.Unlock()
+	if !s.replyOwed || s.asrOnly {
+		return idle
+	}
+	return s.replyIdle
+}
+
+// finish sends FinishSession once, for Stop or Close, whichever runs first.
+func (s *Session) finish() {
+	s.finishOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		if err := s.client.FinishSession(ctx); err != nil {
+			glog.Warningf("finish session error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package voice
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// replyStyles maps the styles SetStyle accepts to the instruction appended to
+// session.dialog.speaking_style. Doubao has no per-turn emotion field in the
+// realtime API, so a style is expressed through the speaking style prompt.
+var replyStyles = map[string]string{
+	"neutral": "",
+	"happy":   "语气开心、轻快，带着笑意。",
+	"serious": "语气严肃、沉稳，措辞认真。",
+	"gentle":  "语气温柔、耐心，语速稍慢。",
+	"excited": "语气兴奋、充满活力。",
+	"sad":     "语气低沉，带着同理心。",
+}
+
+// ErrUnsupportedStyle is returned by SetStyle for a style not in Styles.
+var ErrUnsupportedStyle = errors.New("unsupported reply style")
+
+// Styles lists the styles SetStyle accepts, sorted.
+func Styles() []string {
+	styles := make([]string, 0, len(replyStyles))
+	for style := range replyStyles {
+		styles = append(styles, style)
+	}
+	sort.Strings(styles)
+	return styles
+}
+
+// SetStyle changes how the following replies are spoken, on top of the
+// configured speaking style; "neutral" restores it. Resources that only read
+// the speaking style at session start ignore the update, in which case
+// replies simply keep the configured style; Doubao does not report this.
+func (s *Session) SetStyle(style string) error {
+	hint, ok := replyStyles[style]
+	if !ok {
+		return fmt.Errorf("%w %q, supported: %s", ErrUnsupportedStyle, style, strings.Join(Styles(), ", "))
+	}
+	speaking := strings.TrimSpace(s.cfg.Session.Dialog.SpeakingStyle + hint)
+	if err := s.client.UpdateSpeakingStyle(s.ctx, speaking); err != nil {
+		return fmt.Errorf("update speaking style: %w", err)
+	}
+	return nil
+}
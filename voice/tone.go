@@ -0,0 +1,34 @@
+package voice
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// ToneFrames synthesizes a sine wave in the TTS output encoding, split into
+// frames of frameSamples samples. format follows session.tts.audio_config:
+// "pcm" is float32 little-endian, "pcm_s16le" is int16 little-endian.
+func ToneFrames(sampleRate int, format string, freq float64, totalSamples, frameSamples int) [][]byte {
+	var frames [][]byte
+	for start := 0; start < totalSamples; start += frameSamples {
+		n := min(frameSamples, totalSamples-start)
+		samples := make([]float32, n)
+		for i := range samples {
+			t := float64(start+i) / float64(sampleRate)
+			samples[i] = float32(0.5 * math.Sin(2*math.Pi*freq*t))
+		}
+		frames = append(frames, encodeOutput(samples, format))
+	}
+	return frames
+}
+
+func encodeOutput(samples []float32, format string) []byte {
+	if format == "pcm_s16le" {
+		return float32ToS16Bytes(samples)
+	}
+	buf := make([]byte, len(samples)*4)
+	for i, v := range samples {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+	}
+	return buf
+}
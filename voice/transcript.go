@@ -0,0 +1,178 @@
+package voice
+
+import (
+	"encoding/json"
+
+	"github.com/golang/glog"
+)
+
+// TextPayload is the payload of the user_text and bot_text events.
+type TextPayload struct {
+	// Text is the new fragment (bot_text deltas) or the final sentence.
+	Text string `json:"text"`
+	// Full is the reply accumulated so far in the current turn.
+	Full string `json:"full,omitempty"`
+	// Final is set when the text will not change anymore.
+	Final bool `json:"final"`
+}
+
+type asrResponsePayload struct {
+	Results []asrResult `json:"results"`
+}
+
+type asrResult struct {
+	Text      string `json:"text"`
+	IsInterim bool   `json:"is_interim"`
+	// Confidence and Alternatives are only sent by some ASR models;
+	// Alternatives is the n-best list, usually led by Text itself.
+	Confidence   float64          `json:"confidence"`
+	Alternatives []ASRAlternative `json:"alternatives"`
+	// Language and LanguageProb are set when ASR auto-detects the
+	// spoken language.
+	Language     string  `json:"language"`
+	LanguageProb float64 `json:"language_prob"`
+}
+
+// ASRPayload is the payload of the asr event, sent for every final user
+// utterance next to user_text. Alternatives is the n-best list with the top
+// hypothesis first; when Doubao sends only the top hypothesis it is the only
+// element.
+type ASRPayload struct {
+	Text         string           `json:"text"`
+	Confidence   float64          `json:"confidence,omitempty"`
+	Alternatives []ASRAlternative `json:"alternatives"`
+}
+
+// ASRAlternative is one recognition hypothesis. Confidence is omitted when
+// the model does not score hypotheses.
+type ASRAlternative struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// LanguagePayload is the payload of the language event.
+type LanguagePayload struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+	// Speaker is set when the detected language switched the TTS voice.
+	Speaker string `json:"speaker,omitempty"`
+}
+
+type chatResponsePayload struct {
+	Content string `json:"content"`
+	// ReasoningContent is the intermediate reasoning streamed by the newer
+	// models before or alongside the reply.
+	ReasoningContent string `json:"reasoning_content"`
+}
+
+// ThinkingPayload is the payload of the thinking event.
+type ThinkingPayload struct {
+	Text string `json:"text"`
+}
+
+// emitJSON marshals v as the payload of a synthesized event.
+func (s *Session) emitJSON(typ string, eventID int32, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		glog.Warningf("marshal %s event: %v", typ, err)
+		return
+	}
+	s.emit(EventMsg{Type: typ, EventID: eventID, Payload: payload})
+}
+
+// handleASRResponse surfaces final user transcripts as user_text events.
+func (s *Session) handleASRResponse(raw []byte) {
+	var p asrResponsePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		glog.V(1).Infof("decode asr response: %v", err)
+		return
+	}
+	for _, r := range p.Results {
+		if r.Language != "" {
+			s.detectLanguage(r.Language, r.LanguageProb)
+		}
+		if r.Text == "" {
+			continue
+		}
+		s.trackCaption(r.Text, !r.IsInterim)
+		if r.IsInterim {
+			continue
+		}
+		s.emitJSON("user_text", eventASRResponse, TextPayload{Text: r.Text, Final: true})
+		s.emitJSON("asr", eventASRResponse, r.payload())
+		s.postTranscript(r.Text)
+	}
+}
+
+// payload builds the asr event for a final result. The top hypothesis leads
+// the alternatives even when Doubao lists it elsewhere or not at all.
+func (r asrResult) payload() ASRPayload {
+	top := ASRAlternative{Text: r.Text, Confidence: r.Confidence}
+	alts := []ASRAlternative{top}
+	for _, alt := range r.Alternatives {
+		if alt.Text == "" {
+			continue
+		}
+		if alt.Text == r.Text {
+			if alts[0].Confidence == 0 {
+				alts[0].Confidence = alt.Confidence
+			}
+			continue
+		}
+		alts = append(alts, alt)
+	}
+	return ASRPayload{Text: r.Text, Confidence: alts[0].Confidence, Alternatives: alts}
+}
+
+// handleChatResponse forwards each streamed reply delta as a bot_text event
+// carrying both the delta and the accumulated reply, and reasoning deltas as
+// thinking events when the session subscribed to them.
+func (s *Session) handleChatResponse(raw []byte) {
+	var p chatResponsePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		glog.V(1).Infof("decode chat response: %v", err)
+		return
+	}
+	if s.thinking && p.ReasoningContent != "" {
+		s.emitJSON("thinking", eventChatResponse, ThinkingPayload{Text: p.ReasoningContent})
+	}
+	if p.Content == "" {
+		return
+	}
+	s.botText.WriteString(p.Content)
+	s.emitJSON("bot_text", eventChatResponse, TextPayload{Text: p.Content, Full: s.botText.String()})
+}
+
+// handleChatEnded emits the complete reply, resets the accumulator and, with
+// a fallback TTS, starts watching for the reply's audio.
+func (s *Session) handleChatEnded() {
+	full := s.botText.String()
+	s.botText.Reset()
+	s.emitJSON("bot_text", eventChatEnded, TextPayload{Full: full, Final: true})
+	if s.asrOnly || !s.cfg.Session.TTS.AudioEnabled() {
+		s.endTextReply()
+	}
+	if s.fallback != nil && full != "" && !s.asrOnly && s.cfg.Session.TTS.AudioEnabled() {
+		s.fallbackWG.Add(1)
+		go s.watchFallback(full, s.fallbackGen.Load())
+	}
+}
+
+// detectLanguage emits a language event when the detected language changes
+// and switches to the speaker configured for it, if any.
+func (s *Session) detectLanguage(lang string, confidence float64) {
+	if lang == s.language {
+		return
+	}
+	s.language = lang
+	evt := LanguagePayload{Language: lang, Confidence: confidence}
+	if speaker, ok := s.cfg.Session.TTS.LanguageSpeakers[lang]; ok {
+		switched, err := s.switchSpeaker(speaker)
+		if err != nil {
+			glog.Warningf("switch speaker for %s: %v", lang, err)
+		} else if switched {
+			evt.Speaker = speaker
+		}
+	}
+	s.emitJSON("language", eventASRResponse, evt)
+}
@@ -0,0 +1,29 @@
+package voice
+
+// TurnLimitPayload is the body of the turn_limit_reached event, sent when
+// the user's turn that reaches session.max_turns ends.
+type TurnLimitPayload struct {
+	MaxTurns int `json:"max_turns"`
+}
+
+// countTurn counts a finished user turn. The turn reaching
+// session.max_turns still gets its reply; once that reply ends the session
+// stops like after a client stop. Counting user turns rather than replies
+// keeps barge-ins accurate: an interrupted reply and the turn that cut it
+// count once, as the one user turn.
+func (s *Session) countTurn() {
+	limit := s.cfg.Session.MaxTurns
+	if limit == 0 || s.asrOnly {
+		return
+	}
+	s.announceMu.Lock()
+	s.turns++
+	reached := s.turns == limit
+	if reached {
+		s.finalTurn = true
+	}
+	s.announceMu.Unlock()
+	if reached {
+		s.emitJSON("turn_limit_reached", 0, TurnLimitPayload{MaxTurns: limit})
+	}
+}
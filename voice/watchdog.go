@@ -0,0 +1,48 @@
+package voice
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/metrics"
+)
+
+// ErrStalled ends a session whose Doubao connection delivered nothing for
+// session.read_stall_timeout_ms after input it must answer.
+var ErrStalled = errors.New("doubao connection stalled")
+
+// watchReads ends the session when consume is blocked in Read and Doubao has
+// not sent anything for timeout since input it must answer. Doubao reads have
+// no deadline, so a connection that stays open but goes quiet after an
+// abnormal upstream state would otherwise keep the session alive forever.
+// A blocked Read alone is not a stall: Doubao is quiet while the user is.
+// Aborting the client unblocks the Read.
+func (s *Session) watchReads(timeout time.Duration) {
+	defer s.wg.Done()
+	wait := timeout
+	for {
+		select {
+		case <-s.clock.After(wait):
+		case <-s.ctx.Done():
+			return
+		}
+		wait = timeout
+		since := s.awaitingSince.Load()
+		if since == 0 || s.readingSince.Load() == 0 {
+			continue // nothing awaited, or consume is between reads
+		}
+		waited := s.clock.Now().Sub(time.Unix(0, since))
+		if waited < timeout {
+			wait = timeout - waited
+			continue
+		}
+		glog.Warningf("session %s: no message from doubao %s after input, aborting", s.ID(), waited.Round(time.Millisecond))
+		metrics.SessionsStalled.Add(1)
+		s.setError(fmt.Errorf("%w: no reply for %s", ErrStalled, timeout))
+		_ = s.client.Abort()
+		return
+	}
+}
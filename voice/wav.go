@@ -0,0 +1,145 @@
+package voice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// WAV fmt chunk audio format codes.
+const (
+	wavFormatPCM   uint16 = 1
+	wavFormatFloat uint16 = 3
+)
+
+// WAVHeader describes the fmt chunk of a RIFF/WAVE file and where its sample
+// data begins.
+type WAVHeader struct {
+	AudioFormat   uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	// DataOffset is the byte offset of the first sample in the parsed buffer.
+	DataOffset int
+	// DataSize is the size of the data chunk as declared by the header. It may
+	// exceed the bytes actually present when the file is streamed.
+	DataSize int
+}
+
+// IsWAV reports whether data starts with a RIFF/WAVE signature.
+func IsWAV(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE"))
+}
+
+// ParseWAVHeader parses the RIFF header up to the start of the data chunk.
+func ParseWAVHeader(data []byte) (WAVHeader, error) {
+	if !IsWAV(data) {
+		return WAVHeader{}, fmt.Errorf("missing RIFF/WAVE signature")
+	}
+	var h WAVHeader
+	haveFmt := false
+	off := 12
+	for off+8 <= len(data) {
+		id := string(data[off : off+4])
+		size := int(binary.LittleEndian.Uint32(data[off+4 : off+8]))
+		body := off + 8
+		switch id {
+		case "fmt ":
+			if size < 16 || body+16 > len(data) {
+				return WAVHeader{}, fmt.Errorf("truncated fmt chunk")
+			}
+			h.AudioFormat = binary.LittleEndian.Uint16(data[body:])
+			h.Channels = int(binary.LittleEndian.Uint16(data[body+2:]))
+			h.SampleRate = int(binary.LittleEndian.Uint32(data[body+4:]))
+			h.BitsPerSample = int(binary.LittleEndian.Uint16(data[body+14:]))
+			haveFmt = true
+		case "data":
+			if !haveFmt {
+				return WAVHeader{}, fmt.Errorf("data chunk before fmt chunk")
+			}
+			h.DataOffset = body
+			h.DataSize = size
+			return h, nil
+		}
+		// Chunks are padded to an even size.
+		off = body + size + size%2
+	}
+	return WAVHeader{}, fmt.Errorf("wav data chunk not found")
+}
+
+// Duration returns the playback length in seconds of the declared data chunk.
+func (h WAVHeader) Duration() float64 {
+	bytesPerSecond := h.SampleRate * h.Channels * h.BitsPerSample / 8
+	if bytesPerSecond == 0 {
+		return 0
+	}
+	return float64(h.DataSize) / float64(bytesPerSecond)
+}
+
+// EncodeWAV wraps 16-bit PCM in a WAV header, as clients may send it as
+// the first frame of a stream.
+func EncodeWAV(pcm []byte, sampleRate, channels int) []byte {
+	return append(wavHeader(wavFormatPCM, sampleRate, channels, 16, len(pcm)), pcm...)
+}
+
+// wavHeader builds a 44-byte RIFF header for dataSize bytes of samples.
+func wavHeader(audioFormat uint16, sampleRate, channels, bitsPerSample, dataSize int) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], audioFormat)
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], uint16(bitsPerSample))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+	return header
+}
+
+// wavWriter streams samples into a WAV file and patches the RIFF sizes when
+// closed.
+type wavWriter struct {
+	f    *os.File
+	size int
+}
+
+func createWAV(path string, audioFormat uint16, sampleRate, channels, bitsPerSample int) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header := wavHeader(audioFormat, sampleRate, channels, bitsPerSample, 0)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wavWriter{f: f}, nil
+}
+
+func (w *wavWriter) Write(data []byte) error {
+	n, err := w.f.Write(data)
+	w.size += n
+	return err
+}
+
+func (w *wavWriter) Close() error {
+	var sizes [4]byte
+	binary.LittleEndian.PutUint32(sizes[:], uint32(36+w.size))
+	if _, err := w.f.WriteAt(sizes[:], 4); err != nil {
+		w.f.Close()
+		return err
+	}
+	binary.LittleEndian.PutUint32(sizes[:], uint32(w.size))
+	if _, err := w.f.WriteAt(sizes[:], 40); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
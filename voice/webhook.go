@@ -0,0 +1,145 @@
+package voice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"meow-ai/config"
+	"meow-ai/metrics"
+)
+
+// TranscriptHook is the body POSTed to session.asr.webhook_url for each
+// final transcript.
+type TranscriptHook struct {
+	SessionID string    `json:"session_id"`
+	Text      string    `json:"text"`
+	IsFinal   bool      `json:"is_final"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookAttempts and webhookBackoff bound the retries of one transcript:
+// waits of 500ms, 1s and 2s between four attempts.
+const (
+	webhookAttempts = 4
+	webhookBackoff  = 500 * time.Millisecond
+)
+
+// transcriptWebhook posts transcripts from a bounded queue on its own
+// goroutine. It outlives the sessions feeding it, so transcripts still
+// queued when a client disconnects are delivered.
+type transcriptWebhook struct {
+	url    string
+	queue  chan TranscriptHook
+	client *http.Client
+}
+
+var (
+	webhooksMu sync.Mutex
+	// webhooks holds one sender per URL, created on first use. Its queue
+	// is sized then; changing webhook_queue needs a restart.
+	webhooks = map[string]*transcriptWebhook{}
+)
+
+func webhookFor(cfg config.ASRConfig) *transcriptWebhook {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	w, ok := webhooks[cfg.WebhookURL]
+	if !ok {
+		w = &transcriptWebhook{
+			url:    cfg.WebhookURL,
+			queue:  make(chan TranscriptHook, cfg.WebhookQueue),
+			client: &http.Client{Timeout: 5 * time.Second},
+		}
+		webhooks[cfg.WebhookURL] = w
+		go w.run()
+	}
+	return w
+}
+
+// enqueue queues hook without blocking, dropping it when the queue is full.
+func (w *transcriptWebhook) enqueue(hook TranscriptHook) {
+	select {
+	case w.queue <- hook:
+	default:
+		metrics.WebhookDrops.Add(1)
+		glog.Warningf("transcript webhook queue full, dropping transcript of session %s", hook.SessionID)
+	}
+}
+
+func (w *transcriptWebhook) run() {
+	for hook := range w.queue {
+		w.deliver(hook)
+	}
+}
+
+// deliver posts hook, retrying with backoff on network errors and 5xx or
+// 429 responses. Other responses are final.
+func (w *transcriptWebhook) deliver(hook TranscriptHook) {
+	body, err := json.Marshal(hook)
+	if err != nil {
+		glog.Warningf("marshal transcript webhook: %v", err)
+		return
+	}
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			metrics.WebhookDrops.Add(1)
+			glog.Warningf("transcript webhook for session %s failed after %d attempts: %v", hook.SessionID, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (w *transcriptWebhook) post(body []byte) (retry bool, err error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status=%d body=%s", resp.StatusCode, data)
+}
+
+// redactPatterns compiles session.asr.webhook_redact, which Validate has
+// already checked.
+func redactPatterns(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		res = append(res, regexp.MustCompile(p))
+	}
+	return res
+}
+
+// postTranscript queues a final transcript for the webhook, if configured.
+func (s *Session) postTranscript(text string) {
+	if s.webhook == nil {
+		return
+	}
+	for _, re := range s.webhookRedact {
+		text = re.ReplaceAllString(text, "***")
+	}
+	s.webhook.enqueue(TranscriptHook{
+		SessionID: s.ID(),
+		Text:      text,
+		IsFinal:   true,
+		Timestamp: s.clock.Now(),
+	})
+}
@@ -0,0 +1,177 @@
+package voices
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"meow-ai/config"
+	"meow-ai/voice"
+)
+
+const (
+	maxReferenceBytes    = 10 << 20
+	minReferenceDuration = 5.0
+	maxReferenceDuration = 60.0
+)
+
+// ErrVoiceExists is returned by Clone when name is already bound to a slot
+// and overwrite was not requested.
+var ErrVoiceExists = errors.New("voice name already exists")
+
+// Formats accepted by the Doubao clone API.
+var referenceFormats = map[string]bool{
+	"wav": true,
+	"mp3": true,
+	"ogg": true,
+	"m4a": true,
+	"aac": true,
+	"pcm": true,
+}
+
+// Cloner uploads reference audio to the Doubao voice clone API and records
+// the resulting speaker under a name.
+type Cloner struct {
+	api    config.APIConfig
+	cfg    config.VoiceCloneConfig
+	store  *Store
+	client *http.Client
+
+	// mu serializes clones so two uploads never claim the same slot.
+	mu sync.Mutex
+}
+
+func NewCloner(api config.APIConfig, cfg config.VoiceCloneConfig, store *Store) *Cloner {
+	return &Cloner{
+		api:    api,
+		cfg:    cfg,
+		store:  store,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+type uploadAudio struct {
+	AudioBytes  string `json:"audio_bytes"`
+	AudioFormat string `json:"audio_format"`
+}
+
+type uploadRequest struct {
+	AppID     string        `json:"appid"`
+	SpeakerID string        `json:"speaker_id"`
+	Audios    []uploadAudio `json:"audios"`
+	Source    int           `json:"source"`
+	Language  int           `json:"language"`
+	ModelType int           `json:"model_type"`
+}
+
+type uploadResponse struct {
+	BaseResp struct {
+		StatusCode    int    `json:"StatusCode"`
+		StatusMessage string `json:"StatusMessage"`
+	} `json:"BaseResp"`
+	SpeakerID string `json:"speaker_id"`
+}
+
+// ValidateReference checks the reference clip before it is uploaded.
+func ValidateReference(audio []byte, format string) error {
+	if !referenceFormats[format] {
+		return fmt.Errorf("unsupported reference audio format %q", format)
+	}
+	if len(audio) == 0 {
+		return fmt.Errorf("reference audio is empty")
+	}
+	if len(audio) > maxReferenceBytes {
+		return fmt.Errorf("reference audio exceeds %d bytes", maxReferenceBytes)
+	}
+	if format != "wav" {
+		return nil
+	}
+	header, err := voice.ParseWAVHeader(audio)
+	if err != nil {
+		return fmt.Errorf("parse wav reference: %w", err)
+	}
+	if d := header.Duration(); d < minReferenceDuration || d > maxReferenceDuration {
+		return fmt.Errorf("reference audio must be between %.0f and %.0f seconds, got %.1f", minReferenceDuration, maxReferenceDuration, d)
+	}
+	return nil
+}
+
+// Clone trains the reference audio into a free speaker slot and returns the
+// speaker ID. A name already bound to a slot is retrained in place only with
+// overwrite; otherwise Clone fails with ErrVoiceExists.
+func (c *Cloner) Clone(ctx context.Context, name string, audio []byte, format string, overwrite bool) (string, error) {
+	if err := ValidateReference(audio, format); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	speakerID, ok := c.store.Resolve(name)
+	if ok && !overwrite {
+		return "", fmt.Errorf("%w: %q", ErrVoiceExists, name)
+	}
+	if !ok {
+		speakerID, ok = c.freeSlot()
+		if !ok {
+			return "", fmt.Errorf("no free voice clone slots")
+		}
+	}
+
+	body, err := json.Marshal(uploadRequest{
+		AppID:     c.api.AppID,
+		SpeakerID: speakerID,
+		Audios:    []uploadAudio{{AudioBytes: base64.StdEncoding.EncodeToString(audio), AudioFormat: format}},
+		Source:    2,
+		ModelType: 1,
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshal clone request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("new clone request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer;"+c.api.AccessKey)
+	req.Header.Set("Resource-Id", c.cfg.ResourceID)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("upload reference audio: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read clone response: %w", err)
+	}
+	var out uploadResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("decode clone response status=%d body=%s: %w", resp.StatusCode, string(data), err)
+	}
+	if resp.StatusCode != http.StatusOK || out.BaseResp.StatusCode != 0 {
+		return "", fmt.Errorf("doubao clone failed status=%d code=%d message=%s", resp.StatusCode, out.BaseResp.StatusCode, out.BaseResp.StatusMessage)
+	}
+	if out.SpeakerID != "" {
+		speakerID = out.SpeakerID
+	}
+	if err := c.store.Put(name, speakerID); err != nil {
+		return "", err
+	}
+	return speakerID, nil
+}
+
+func (c *Cloner) freeSlot() (string, bool) {
+	for _, id := range c.cfg.SpeakerIDs {
+		if !c.store.Assigned(id) {
+			return id, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,71 @@
+// Package voices manages cloned Doubao speakers that sessions can reference
+// by a friendly name.
+package voices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Store persists the mapping from voice name to Doubao speaker ID.
+type Store struct {
+	path string
+
+	mu     sync.Mutex
+	voices map[string]string
+}
+
+// NewStore loads the mapping from path, starting empty if the file does not
+// exist yet.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, voices: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read voice store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.voices); err != nil {
+		return nil, fmt.Errorf("decode voice store: %w", err)
+	}
+	return s, nil
+}
+
+// Resolve returns the speaker ID registered under name.
+func (s *Store) Resolve(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.voices[name]
+	return id, ok
+}
+
+// Assigned reports whether speakerID is already bound to a name.
+func (s *Store) Assigned(speakerID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.voices {
+		if id == speakerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Put binds name to speakerID and persists the mapping.
+func (s *Store) Put(name, speakerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.voices[name] = speakerID
+	data, err := json.MarshalIndent(s.voices, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode voice store: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0o644); err != nil {
+		return fmt.Errorf("write voice store: %w", err)
+	}
+	return nil
+}
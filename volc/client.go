@@ -3,6 +3,7 @@ package volc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -12,6 +13,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
+	"meow-ai/clock"
 	"meow-ai/config"
 )
 
@@ -22,14 +24,59 @@ const (
 	eventFinishSession    int32 = 102
 	eventSayHello         int32 = 300
 	eventUserQuery        int32 = 200
+	eventUpdateConfig     int32 = 201
+	eventEndASR           int32 = 400
+	eventChatTextQuery    int32 = 501
+	eventChatRAGText      int32 = 502
 )
 
 const writeTimeout = 5 * time.Second
 
+// ErrDialogNotFound is returned by Open when Doubao rejects the configured
+// dialog_id, typically because the dialog to resume has expired.
+var ErrDialogNotFound = errors.New("dialog not found")
+
+// statusDialogNotFound is the status Doubao answers StartSession with when
+// the dialog_id is unknown or expired.
+const statusDialogNotFound = 45000003
+
+// isDialogNotFound reports whether a StartSession response rejects the
+// dialog_id.
+func isDialogNotFound(msg *Message) bool {
+	return messageStatus(msg) == statusDialogNotFound
+}
+
+// messageStatus returns the status Doubao attached to an error response:
+// the frame's error code, or else the payload's status_code; 0 when it has
+// neither.
+func messageStatus(msg *Message) uint32 {
+	if msg.ErrorCode != 0 {
+		return msg.ErrorCode
+	}
+	var p struct {
+		StatusCode uint32 `json:"status_code"`
+	}
+	if json.Unmarshal(msg.Payload, &p) != nil {
+		return 0
+	}
+	return p.StatusCode
+}
+
+// ErrClosed is returned when sending on a client that was closed.
+var ErrClosed = errors.New("doubao client closed")
+
 type Client struct {
 	cfg       *config.Config
 	conn      *websocket.Conn
 	sessionID string
+	endpoint  string
+	clock     clock.Clock
+
+	// mu guards conn, sessionFinished and aborted; sendMu serializes
+	// writes, which gorilla/websocket allows only one at a time.
+	mu              sync.Mutex
+	sessionFinished bool
+	aborted         bool
 
 	jsonProto *BinaryProtocol
 	rawProto  *BinaryProtocol
@@ -68,12 +115,42 @@ type DialogPayload struct {
 	Extra             map[string]any         `json:"extra"`
 }
 
+// UpdateConfigPayload changes session settings mid-dialog: the speaker or
+// the dialog's speaking style.
+type UpdateConfigPayload struct {
+	TTS    *UpdateTTSPayload    `json:"tts,omitempty"`
+	Dialog *UpdateDialogPayload `json:"dialog,omitempty"`
+}
+
+type UpdateTTSPayload struct {
+	Speaker string `json:"speaker"`
+}
+
+type UpdateDialogPayload struct {
+	SpeakingStyle string `json:"speaking_style"`
+}
+
 type SayHelloPayload struct {
 	Content string `json:"content"`
 }
 
+type ChatTextQueryPayload struct {
+	Content string `json:"content"`
+}
+
+// ChatRAGTextPayload carries external knowledge. ExternalRAG is a JSON-encoded
+// array of ragItem.
+type ChatRAGTextPayload struct {
+	ExternalRAG string `json:"external_rag"`
+}
+
+type ragItem struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
 func NewClient(cfg *config.Config) *Client {
-	jsonProto := newBaseProtocol()
+	jsonProto := newBaseProtocol(cfg.API.Protocol)
 	jsonProto.SetSerialization(SerializationJSON)
 
 	rawProto := jsonProto.Clone()
@@ -81,43 +158,49 @@ func NewClient(cfg *config.Config) *Client {
 
 	return &Client{
 		cfg:       cfg,
+		clock:     clock.Real,
 		jsonProto: jsonProto,
 		rawProto:  rawProto,
 	}
 }
 
-func newBaseProtocol() *BinaryProtocol {
+// SetClock replaces the clock used for deadlines and endpoint cooldowns.
+func (c *Client) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// newBaseProtocol builds the client framing from api.protocol. A zero config
+// (not validated) gets the current defaults, Version1 with a 4 byte header.
+func newBaseProtocol(cfg config.ProtocolConfig) *BinaryProtocol {
+	version, headerSize := Version1, HeaderSize4
+	if cfg.Version > 0 {
+		version = VersionBits(cfg.Version << 4)
+	}
+	if cfg.HeaderSize > 0 {
+		headerSize = HeaderSizeBits(cfg.HeaderSize / 4)
+	}
 	p := NewBinaryProtocol()
-	p.SetVersion(Version1)
-	p.SetHeaderSize(HeaderSize4)
+	p.SetVersion(version)
+	p.SetHeaderSize(headerSize)
 	p.SetCompression(CompressionNone, nil)
 	p.containsSequence = ContainsSequence
 	return p
 }
 
 func (c *Client) Open(ctx context.Context) error {
-	if c.conn != nil {
+	if c.currentConn() != nil {
 		return fmt.Errorf("client already opened")
 	}
 
-	dialCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
-
-	conn, resp, err := websocket.DefaultDialer.DialContext(dialCtx, c.cfg.API.URL, http.Header{
-		"X-Api-Resource-Id": []string{c.cfg.API.ResourceID},
-		"X-Api-Access-Key":  []string{c.cfg.API.AccessKey},
-		"X-Api-App-Key":     []string{c.cfg.API.AppKey},
-		"X-Api-App-ID":      []string{c.cfg.API.AppID},
-		"X-Api-Connect-Id":  []string{uuid.NewString()},
-	})
+	conn, err := c.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("dial doubao api: %w", err)
-	}
-	if resp != nil {
-		glog.Infof("doubao logid: %s", resp.Header.Get("X-Tt-Logid"))
+		return err
 	}
+	conn.SetReadLimit(c.cfg.API.MaxMessageBytes)
 
+	c.mu.Lock()
 	c.conn = conn
+	c.mu.Unlock()
 	c.sessionID = uuid.NewString()
 
 	if err := c.startConnection(ctx); err != nil {
@@ -131,6 +214,87 @@ func (c *Client) Open(ctx context.Context) error {
 	return nil
 }
 
+// dial connects to the first reachable endpoint, skipping endpoints that
+// recently failed. A failed endpoint is put in cooldown for
+// api.failover_cooldown_ms.
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	if err := rateLimitBackoff.check(c.clock.Now()); err != nil {
+		return nil, err
+	}
+	release, err := dialLimit.acquire(ctx, c.clock, c.cfg.API.Reconnect)
+	if err != nil {
+		return nil, fmt.Errorf("wait for dial slot: %w", err)
+	}
+	defer release()
+	// A rate limit may have tripped while this dial queued.
+	if err := rateLimitBackoff.check(c.clock.Now()); err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ep := range endpointHealth.order(c.cfg.API.Endpoints, c.clock.Now()) {
+		conn, err := c.dialEndpoint(ctx, ep)
+		var rl *RateLimitError
+		if errors.As(err, &rl) {
+			// The limit is per account, so other endpoints would refuse
+			// too; leave endpoint health alone and stop.
+			return nil, err
+		}
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				// The caller gave up, which says nothing about the
+				// endpoint; keep it out of the shared cooldown.
+				break
+			}
+			glog.Warningf("dial doubao endpoint %s: %v", ep.URL, err)
+			endpointHealth.markDown(ep.URL, c.clock.Now().Add(time.Duration(c.cfg.API.FailoverCooldownMS)*time.Millisecond))
+			continue
+		}
+		endpointHealth.markGood(ep.URL)
+		c.endpoint = ep.URL
+		glog.Infof("doubao connected via endpoint %s", ep.URL)
+		return conn, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoints configured")
+	}
+	return nil, fmt.Errorf("dial doubao api: %w", lastErr)
+}
+
+func (c *Client) dialEndpoint(ctx context.Context, ep config.EndpointConfig) (*websocket.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, time.Duration(c.cfg.API.DialTimeoutMS)*time.Millisecond)
+	defer cancel()
+
+	header := http.Header{
+		"X-Api-Resource-Id": []string{c.cfg.API.ResourceID},
+		"X-Api-Access-Key":  []string{c.cfg.API.AccessKey},
+		"X-Api-App-Key":     []string{c.cfg.API.AppKey},
+		"X-Api-App-ID":      []string{c.cfg.API.AppID},
+		"X-Api-Connect-Id":  []string{uuid.NewString()},
+	}
+	for k, v := range ep.Headers {
+		header.Set(k, v)
+	}
+	dialer, err := newDialer(c.cfg.API.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := dialer.DialContext(dialCtx, ep.URL, header)
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimitBackoff.trip(c.clock.Now(), retryAfter(resp), "dial returned 429")
+	}
+	if err != nil {
+		if c.cfg.API.ProxyURL != "" {
+			return nil, fmt.Errorf("via proxy %s: %w", proxyHost(c.cfg.API.ProxyURL), err)
+		}
+		return nil, err
+	}
+	if resp != nil {
+		glog.Infof("doubao logid: %s", resp.Header.Get("X-Tt-Logid"))
+	}
+	return conn, nil
+}
+
 func (c *Client) startConnection(ctx context.Context) error {
 	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
@@ -143,17 +307,33 @@ func (c *Client) startConnection(ctx context.Context) error {
 		return fmt.Errorf("send start connection: %w", err)
 	}
 
-	resp, err := c.readMessage(ctx)
+	resp, proto, err := c.readFrame(ctx)
 	if err != nil {
 		return fmt.Errorf("wait connection started: %w", err)
 	}
+	c.checkProtocol(proto)
 	if resp.Type != MsgTypeFullServer || resp.Event != 50 {
+		if err := c.RateLimitFromMessage(resp); err != nil {
+			return err
+		}
 		return fmt.Errorf("unexpected connection response: type=%s event=%d", resp.Type, resp.Event)
 	}
 	glog.Infof("doubao connection established, connect_id=%s", resp.ConnectID)
 	return nil
 }
 
+// checkProtocol compares the framing of Doubao's first reply with ours. The
+// parser follows whatever header the server sends, so a newer version is
+// not fatal by itself, but it is the first sign that api.protocol needs
+// updating before payloads start to change.
+func (c *Client) checkProtocol(server *BinaryProtocol) {
+	glog.V(1).Infof("doubao protocol version=%d header_size=%d", server.Version(), server.HeaderSize())
+	if server.Version() != c.jsonProto.Version() || server.HeaderSize() != c.jsonProto.HeaderSize() {
+		glog.Warningf("doubao speaks protocol version=%d header_size=%d, configured api.protocol is version=%d header_size=%d",
+			server.Version(), server.HeaderSize(), c.jsonProto.Version(), c.jsonProto.HeaderSize())
+	}
+}
+
 func (c *Client) startSession(ctx context.Context) error {
 	payload := StartSessionPayload{
 		ASR: ASRPayload{
@@ -192,6 +372,11 @@ func (c *Client) startSession(ctx context.Context) error {
 			},
 		},
 	}
+	if n := c.cfg.Session.Dialog.MaxResponseTokens; n > 0 {
+		payload.Dialog.Extra["max_response_tokens"] = n
+	}
+	mergeExtra(payload.ASR.Extra, c.cfg.Session.ASR.Extra.Raw)
+	mergeExtra(payload.Dialog.Extra, c.cfg.Session.Dialog.Extra.Raw)
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("marshal start session payload: %w", err)
@@ -213,12 +398,28 @@ func (c *Client) startSession(ctx context.Context) error {
 		return fmt.Errorf("wait start session response: %w", err)
 	}
 	if resp.Type != MsgTypeFullServer || resp.Event != 150 {
+		if err := c.RateLimitFromMessage(resp); err != nil {
+			return err
+		}
+		if c.cfg.Session.Dialog.DialogID != "" && isDialogNotFound(resp) {
+			return fmt.Errorf("%w: %s", ErrDialogNotFound, string(resp.Payload))
+		}
 		return fmt.Errorf("unexpected start session response: type=%s event=%d payload=%s", resp.Type, resp.Event, string(resp.Payload))
 	}
+	if err := c.checkFeatures(resp.Payload); err != nil {
+		return err
+	}
 	glog.Infof("doubao session started, session_id=%s", resp.SessionID)
 	return nil
 }
 
+// mergeExtra copies passthrough config keys into an outgoing Extra map.
+func mergeExtra(dst, raw map[string]any) {
+	for k, v := range raw {
+		dst[k] = v
+	}
+}
+
 func (c *Client) SayHello(ctx context.Context, content string) error {
 	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
@@ -234,6 +435,83 @@ func (c *Client) SayHello(ctx context.Context, content string) error {
 	return c.writeMessage(ctx, msg, SerializationJSON)
 }
 
+// UpdateSpeaker switches the TTS voice for the following replies.
+func (c *Client) UpdateSpeaker(ctx context.Context, speaker string) error {
+	return c.updateConfig(ctx, UpdateConfigPayload{TTS: &UpdateTTSPayload{Speaker: speaker}})
+}
+
+// UpdateSpeakingStyle replaces the dialog's speaking style for the following
+// replies.
+func (c *Client) UpdateSpeakingStyle(ctx context.Context, style string) error {
+	return c.updateConfig(ctx, UpdateConfigPayload{Dialog: &UpdateDialogPayload{SpeakingStyle: style}})
+}
+
+func (c *Client) updateConfig(ctx context.Context, payload UpdateConfigPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal update config payload: %w", err)
+	}
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("new update config message: %w", err)
+	}
+	msg.Event = eventUpdateConfig
+	msg.SessionID = c.sessionID
+	msg.Payload = body
+	return c.writeMessage(ctx, msg, SerializationJSON)
+}
+
+// SendText sends a typed user query, the text counterpart of SendAudio.
+func (c *Client) SendText(ctx context.Context, content string) error {
+	body, err := json.Marshal(ChatTextQueryPayload{Content: content})
+	if err != nil {
+		return fmt.Errorf("marshal text query payload: %w", err)
+	}
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("new text query message: %w", err)
+	}
+	msg.Event = eventChatTextQuery
+	msg.SessionID = c.sessionID
+	msg.Payload = body
+	return c.writeMessage(ctx, msg, SerializationJSON)
+}
+
+// SendSystemEvent injects non-spoken context into the dialog. It is sent as
+// external RAG text: Doubao uses it as reference material for the next reply
+// but never reads it out or treats it as a user turn.
+func (c *Client) SendSystemEvent(ctx context.Context, content string) error {
+	items, err := json.Marshal([]ragItem{{Title: "context", Content: content}})
+	if err != nil {
+		return fmt.Errorf("marshal rag items: %w", err)
+	}
+	body, err := json.Marshal(ChatRAGTextPayload{ExternalRAG: string(items)})
+	if err != nil {
+		return fmt.Errorf("marshal rag payload: %w", err)
+	}
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("new rag text message: %w", err)
+	}
+	msg.Event = eventChatRAGText
+	msg.SessionID = c.sessionID
+	msg.Payload = body
+	return c.writeMessage(ctx, msg, SerializationJSON)
+}
+
+// EndASR tells Doubao the user finished speaking, ending the utterance
+// without waiting for silence-based endpointing.
+func (c *Client) EndASR(ctx context.Context) error {
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("new end asr message: %w", err)
+	}
+	msg.Event = eventEndASR
+	msg.SessionID = c.sessionID
+	msg.Payload = []byte("{}")
+	return c.writeMessage(ctx, msg, SerializationJSON)
+}
+
 func (c *Client) SendAudio(ctx context.Context, pcm []byte) error {
 	msg, err := NewMessage(MsgTypeAudioOnlyClient, MsgTypeFlagWithEvent)
 	if err != nil {
@@ -245,20 +523,42 @@ func (c *Client) SendAudio(ctx context.Context, pcm []byte) error {
 	return c.writeMessage(ctx, msg, SerializationRaw)
 }
 
-func (c *Client) readMessage(_ context.Context) (*Message, error) {
-	_ = c.conn.SetReadDeadline(time.Time{})
-	mt, frame, err := c.conn.ReadMessage()
-	if err != nil {
-		return nil, err
+// keepAliveFrame is 20 ms of 16 kHz s16 mono silence.
+var keepAliveFrame = make([]byte, 640)
+
+// SendKeepAlive sends a short frame of silence on the audio query event so
+// Doubao does not end the ASR session during a long pause. Silence is what
+// the endpointer already sees while the user is quiet, so it never splits or
+// ends an utterance.
+func (c *Client) SendKeepAlive(ctx context.Context) error {
+	return c.SendAudio(ctx, keepAliveFrame)
+}
+
+func (c *Client) readMessage(ctx context.Context) (*Message, error) {
+	msg, _, err := c.readFrame(ctx)
+	return msg, err
+}
+
+// readFrame reads one message together with the framing it was sent with.
+func (c *Client) readFrame(ctx context.Context) (*Message, *BinaryProtocol, error) {
+	conn := c.currentConn()
+	if conn == nil {
+		return nil, nil, ErrClosed
 	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return nil, fmt.Errorf("unsupported message type: %d", mt)
+	// A zero deadline (no ctx deadline) blocks until a frame arrives.
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	mt, frame, err := conn.ReadMessage()
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return nil, nil, fmt.Errorf("doubao frame exceeds api.max_message_bytes (%d): %w", c.cfg.API.MaxMessageBytes, err)
 	}
-	msg, _, err := Unmarshal(frame, ContainsSequence)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
+		return nil, nil, fmt.Errorf("unsupported message type: %d", mt)
 	}
-	return msg, nil
+	return Unmarshal(frame, ContainsSequence)
 }
 
 func (c *Client) Read(ctx context.Context) (*Message, error) {
@@ -291,28 +591,78 @@ func (c *Client) writeMessage(_ context.Context, msg *Message, serialization Ser
 	if err != nil {
 		return err
 	}
-	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
-	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+	conn := c.currentConn()
+	if conn == nil {
+		return ErrClosed
+	}
+	_ = conn.SetWriteDeadline(c.clock.Now().Add(writeTimeout))
+	return conn.WriteMessage(websocket.BinaryMessage, frame)
 }
 
-func (c *Client) Close() error {
-	if c.conn == nil {
+// currentConn returns the open connection, nil once the client is closed.
+func (c *Client) currentConn() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// FinishSession asks Doubao to end the dialog session. The server answers
+// with a SessionFinished event on the read path, so callers that own a read
+// loop can let it drain naturally before calling Close.
+func (c *Client) FinishSession(ctx context.Context) error {
+	c.mu.Lock()
+	if c.conn == nil || c.sessionFinished {
+		c.mu.Unlock()
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	c.sessionFinished = true
+	c.mu.Unlock()
+	return c.finishSession(ctx)
+}
 
-	if err := c.finishSession(ctx); err != nil {
-		glog.Warningf("finish session error: %v", err)
+// Abort closes the underlying connection without the finish handshake,
+// unblocking any pending Read.
+func (c *Client) Abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.aborted {
+		return nil
 	}
-	if err := c.finishConnection(ctx); err != nil {
-		glog.Warningf("finish connection error: %v", err)
+	c.aborted = true
+	return c.conn.Close()
+}
+
+// Close finishes the session and connection unless the client was aborted,
+// then closes the connection. Sends after Close fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conn, aborted := c.conn, c.aborted
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
 	}
-	err := c.conn.Close()
+	if !aborted {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := c.FinishSession(ctx); err != nil {
+			glog.Warningf("finish session error: %v", err)
+		}
+		if err := c.finishConnection(ctx); err != nil {
+			glog.Warningf("finish connection error: %v", err)
+		}
+	}
+
+	c.mu.Lock()
 	c.conn = nil
-	return err
+	aborted = c.aborted
+	c.mu.Unlock()
+	if aborted {
+		return nil
+	}
+	return conn.Close()
 }
 
 func (c *Client) finishSession(ctx context.Context) error {
@@ -340,16 +690,27 @@ func (c *Client) finishConnection(ctx context.Context) error {
 	if err := c.writeMessage(ctx, msg, SerializationJSON); err != nil {
 		return fmt.Errorf("send finish connection: %w", err)
 	}
-	resp, err := c.readMessage(ctx)
-	if err != nil {
-		return fmt.Errorf("wait finish connection response: %w", err)
-	}
-	if resp.Type != MsgTypeFullServer || resp.Event != 52 {
-		return fmt.Errorf("unexpected finish connection response: type=%s event=%d", resp.Type, resp.Event)
+	// Session-level messages (audio, SessionFinished) may still be in flight
+	// ahead of ConnectionFinished.
+	for {
+		resp, err := c.readMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("wait finish connection response: %w", err)
+		}
+		if resp.Type == MsgTypeFullServer && resp.Event == 52 {
+			return nil
+		}
+		if resp.Type == MsgTypeError || resp.Event == 51 {
+			return fmt.Errorf("unexpected finish connection response: type=%s event=%d", resp.Type, resp.Event)
+		}
 	}
-	return nil
 }
 
 func (c *Client) SessionID() string {
 	return c.sessionID
 }
+
+// Endpoint returns the URL of the endpoint the client is connected to.
+func (c *Client) Endpoint() string {
+	return c.endpoint
+}
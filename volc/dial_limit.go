@@ -0,0 +1,73 @@
+package volc
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"meow-ai/clock"
+	"meow-ai/config"
+	"meow-ai/metrics"
+)
+
+// dialLimit is shared by all clients. A lost Doubao connection ends its
+// session, so when Doubao blips every client reconnects by opening a new
+// session at the same moment; the limit makes those dials queue instead of
+// arriving at once. It is sized by the first dial and needs a restart to
+// change.
+var dialLimit = &dialLimiter{}
+
+type dialLimiter struct {
+	once sync.Once
+	sem  chan struct{}
+}
+
+// acquire waits for a dial slot and returns the func releasing it. When every
+// slot is busy the caller first sleeps a random jitter, so queued dials do
+// not all go the moment slots free up.
+func (l *dialLimiter) acquire(ctx context.Context, clk clock.Clock, cfg config.ReconnectConfig) (func(), error) {
+	l.once.Do(func() {
+		if cfg.MaxConcurrent > 0 {
+			l.sem = make(chan struct{}, cfg.MaxConcurrent)
+		}
+	})
+	metrics.DoubaoDialsQueued.Add(1)
+	err := l.wait(ctx, clk, cfg)
+	metrics.DoubaoDialsQueued.Add(-1)
+	if err != nil {
+		return nil, err
+	}
+	metrics.DoubaoDialsInProgress.Add(1)
+	return func() {
+		metrics.DoubaoDialsInProgress.Add(-1)
+		if l.sem != nil {
+			<-l.sem
+		}
+	}, nil
+}
+
+func (l *dialLimiter) wait(ctx context.Context, clk clock.Clock, cfg config.ReconnectConfig) error {
+	if l.sem == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if cfg.JitterMS > 0 {
+		jitter := rand.N(time.Duration(cfg.JitterMS) * time.Millisecond)
+		select {
+		case <-clk.After(jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
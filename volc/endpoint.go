@@ -0,0 +1,60 @@
+package volc
+
+import (
+	"sync"
+	"time"
+
+	"meow-ai/config"
+)
+
+// endpointHealth is shared by all clients in the process so that a region
+// that failed to dial is skipped by later sessions until its cooldown ends,
+// and the most recent successful endpoint is tried first.
+var endpointHealth = &endpointTracker{downUntil: make(map[string]time.Time)}
+
+type endpointTracker struct {
+	mu        sync.Mutex
+	lastGood  string
+	downUntil map[string]time.Time
+}
+
+// order returns the endpoints in the order they should be dialed: the
+// last-good endpoint first, then the remaining healthy ones in config order.
+// Endpoints in cooldown are skipped unless every endpoint is cooling down.
+func (t *endpointTracker) order(endpoints []config.EndpointConfig, now time.Time) []config.EndpointConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var healthy, cooling []config.EndpointConfig
+	for _, ep := range endpoints {
+		if until, ok := t.downUntil[ep.URL]; ok && now.Before(until) {
+			cooling = append(cooling, ep)
+			continue
+		}
+		if ep.URL == t.lastGood {
+			healthy = append([]config.EndpointConfig{ep}, healthy...)
+			continue
+		}
+		healthy = append(healthy, ep)
+	}
+	if len(healthy) == 0 {
+		return cooling
+	}
+	return healthy
+}
+
+func (t *endpointTracker) markGood(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastGood = url
+	delete(t.downUntil, url)
+}
+
+func (t *endpointTracker) markDown(url string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downUntil[url] = until
+	if t.lastGood == url {
+		t.lastGood = ""
+	}
+}
@@ -0,0 +1,60 @@
+package volc
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// FeatureUnavailableError reports a session feature the configured
+// resource_id does not provide, such as websearch or a dialog model.
+type FeatureUnavailableError struct {
+	Feature string
+	Detail  string
+}
+
+func (e *FeatureUnavailableError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("doubao feature unavailable: %s", e.Feature)
+	}
+	return fmt.Sprintf("doubao feature unavailable: %s: %s", e.Feature, e.Detail)
+}
+
+// sessionStartedPayload is the part of the SessionStarted body the
+// capability check reads. Resources that do not report capabilities omit
+// supported_features, which means unknown rather than unsupported.
+type sessionStartedPayload struct {
+	SupportedFeatures *struct {
+		VolcWebsearch *bool    `json:"volc_websearch"`
+		Models        []string `json:"models"`
+	} `json:"supported_features"`
+}
+
+// checkFeatures compares the features the session asked for with what the
+// SessionStarted response reports. A missing feature fails the session when
+// session.dialog.require_features is set and is logged otherwise, since the
+// feature would otherwise fail silently mid-dialog.
+func (c *Client) checkFeatures(payload []byte) error {
+	var p sessionStartedPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.SupportedFeatures == nil {
+		return nil
+	}
+	supported := p.SupportedFeatures
+	var missing *FeatureUnavailableError
+	if c.cfg.Session.Dialog.Extra.EnableVolcWebsearch && supported.VolcWebsearch != nil && !*supported.VolcWebsearch {
+		missing = &FeatureUnavailableError{Feature: "websearch", Detail: "resource " + c.cfg.API.ResourceID + " has no websearch"}
+	} else if model := c.cfg.Session.Dialog.Extra.Model; len(supported.Models) > 0 && !slices.Contains(supported.Models, model) {
+		missing = &FeatureUnavailableError{Feature: "model " + model, Detail: "supported: " + strings.Join(supported.Models, ", ")}
+	}
+	if missing == nil {
+		return nil
+	}
+	if c.cfg.Session.Dialog.RequireFeatures {
+		return missing
+	}
+	glog.Warningf("%v", missing)
+	return nil
+}
@@ -0,0 +1,96 @@
+package volc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newDialer returns the websocket dialer for Doubao connections, routed
+// through api.proxy_url when set and through the HTTPS_PROXY environment
+// otherwise, as websocket.DefaultDialer does. gorilla/websocket handles http
+// and socks5 proxies itself; https proxies are reached over TLS by
+// httpsProxyDial.
+func newDialer(proxyURL string) (*websocket.Dialer, error) {
+	d := *websocket.DefaultDialer
+	if proxyURL == "" {
+		return &d, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse api.proxy_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+		d.Proxy = http.ProxyURL(u)
+	case "https":
+		d.Proxy = nil
+		d.NetDialContext = httpsProxyDial(u)
+	default:
+		return nil, fmt.Errorf("unsupported api.proxy_url scheme %q", u.Scheme)
+	}
+	return &d, nil
+}
+
+// httpsProxyDial opens a TLS connection to the proxy and tunnels to addr
+// with CONNECT.
+func httpsProxyDial(proxy *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host := proxy.Host
+		if proxy.Port() == "" {
+			host = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: proxy.Hostname()}}
+		conn, err := dialer.DialContext(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if user := proxy.User; user != nil {
+			password, _ := user.Password()
+			credential := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credential)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy CONNECT: %s", resp.Status)
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// proxyHost returns the proxy address without credentials for error messages.
+func proxyHost(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,84 @@
+package volc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"meow-ai/metrics"
+)
+
+// defaultRetryAfter is the backoff used when Doubao rate-limits us without
+// saying for how long.
+const defaultRetryAfter = 5 * time.Second
+
+// RateLimitError reports that Volcengine is rate-limiting this account.
+// RetryAfter is how long every client in the process holds off.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Detail     string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("doubao rate limited, retry after %s: %s", e.RetryAfter, e.Detail)
+}
+
+// rateLimitBackoff is shared by all clients: a rate limit is per account,
+// so once one session sees it, no session dials until it expires instead of
+// each retrying and making it worse.
+var rateLimitBackoff = &backoff{}
+
+type backoff struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// check returns a *RateLimitError while the backoff is active.
+func (b *backoff) check(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.until) {
+		return &RateLimitError{RetryAfter: b.until.Sub(now), Detail: "backing off"}
+	}
+	return nil
+}
+
+// trip starts or extends the backoff and returns the error to report.
+func (b *backoff) trip(now time.Time, retryAfter time.Duration, detail string) *RateLimitError {
+	metrics.RateLimited.Add(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := now.Add(retryAfter); until.After(b.until) {
+		b.until = until
+	}
+	return &RateLimitError{RetryAfter: b.until.Sub(now), Detail: detail}
+}
+
+// retryAfter parses a Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return defaultRetryAfter
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return defaultRetryAfter
+}
+
+// statusRateLimited is the status Doubao answers with when the account
+// exceeds its concurrency or QPS quota.
+const statusRateLimited = 45000292
+
+// RateLimitFromMessage returns a *RateLimitError, and trips the shared
+// backoff, if msg is a rate-limit error from Doubao; otherwise nil.
+func (c *Client) RateLimitFromMessage(msg *Message) error {
+	if msg.Type != MsgTypeError && msg.Event != 51 && msg.Event != 153 {
+		return nil
+	}
+	if messageStatus(msg) != statusRateLimited {
+		return nil
+	}
+	return rateLimitBackoff.trip(c.clock.Now(), defaultRetryAfter, string(msg.Payload))
+}
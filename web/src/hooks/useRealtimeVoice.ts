@@ -104,6 +104,11 @@ const useRealtimeVoice = () => {
         setStatus("running")
         return
       }
+      if (message.type === "audio_flush") {
+        // 服务端打断播报，清空本地播放缓冲
+        stopAllAudio()
+        return
+      }
       if (message.type === "error") {
         setStatus("error")
         cleanup()